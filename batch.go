@@ -0,0 +1,214 @@
+package bigset
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// defaultBatchSize is the default number of rows inserted per transaction
+// when loading many values at once.
+const defaultBatchSize = 10000
+
+// batch executes a statement taking a key and value for each item it
+// is given, committing a transaction after every `size` items. This is
+// much faster than autocommitting each row, without holding the write
+// lock for the entire duration of a very large load.
+// Nothing else may use the writer while a batch has uncommitted items.
+type batch[T any] struct {
+	b     *Bigset[T]
+	name  string
+	query string
+	// if set, this is executed with the key of each item for which
+	// the query affected no rows
+	onConflict     string
+	size           int
+	tx             *sql.Tx
+	stmt           *sql.Stmt
+	onConflictStmt *sql.Stmt
+	pending        int
+	affected       int64
+}
+
+func (b *Bigset[T]) newBatch(name, query string) *batch[T] {
+	return &batch[T]{b: b, name: name, query: query, size: b.batchSize}
+}
+
+// newAddBatch returns a batch which adds items to the named set.
+func (b *Bigset[T]) newAddBatch(name string) *batch[T] {
+	t := b.newBatch(name, b.addSQL(name))
+	t.onConflict = b.incrementSQL(name)
+	return t
+}
+
+// add executes the statement for a single item, returning the number
+// of rows affected.
+func (t *batch[T]) add(ctx context.Context, value *T) (int64, error) {
+	if t.tx == nil {
+		if err := t.b.writable(); err != nil {
+			return -1, err
+		}
+		// this must be prepared before the transaction claims
+		// the writer's only connection
+		stmt, err := t.b.prepare(ctx, t.name, t.query)
+		if err != nil {
+			return -1, err
+		}
+		var onConflictStmt *sql.Stmt
+		if t.onConflict != "" {
+			if onConflictStmt, err = t.b.prepare(ctx, t.name, t.onConflict); err != nil {
+				return -1, err
+			}
+		}
+		tx, err := t.b.db.Writer().BeginTx(ctx, nil)
+		if err != nil {
+			return -1, err
+		}
+		t.b.writes.Add(1)
+		t.tx, t.stmt = tx, tx.StmtContext(ctx, stmt)
+		if onConflictStmt != nil {
+			t.onConflictStmt = tx.StmtContext(ctx, onConflictStmt)
+		}
+	}
+	k, args, err := t.b.row(value)
+	if err != nil {
+		return -1, err
+	}
+	execResult, err := t.stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return -1, err
+	}
+	ra, err := execResult.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	t.b.filterAdd(t.name, k)
+	if ra == 0 && t.onConflictStmt != nil {
+		if _, err := t.onConflictStmt.ExecContext(ctx, k); err != nil {
+			return -1, err
+		}
+	}
+	t.affected += ra
+	t.pending++
+	if t.pending >= t.size {
+		if err := t.commit(); err != nil {
+			return -1, err
+		}
+	}
+	return ra, nil
+}
+
+// commit commits any pending items.
+func (t *batch[T]) commit() error {
+	if t.tx == nil {
+		return nil
+	}
+	tx := t.tx
+	t.tx, t.stmt, t.onConflictStmt, t.pending = nil, nil, nil, 0
+	defer t.b.writes.Add(-1)
+	return tx.Commit()
+}
+
+// rollback discards any uncommitted items. It is safe to call
+// after commit, so it can be deferred.
+func (t *batch[T]) rollback() {
+	if t.tx == nil {
+		return
+	}
+	_ = t.tx.Rollback()
+	t.tx, t.stmt, t.onConflictStmt, t.pending = nil, nil, nil, 0
+	t.b.writes.Add(-1)
+}
+
+// maxParameters is the most parameters bound to a single statement.
+// This is sqlite's historical default limit, so is safe for any build.
+const maxParameters = 999
+
+// maxCompoundSelect is the most SELECTs which can be combined into a single
+// compound statement, such as with UNION ALL, which is sqlite's default.
+const maxCompoundSelect = 500
+
+// chunks splits `values` into consecutive slices of at most `size` elements.
+func chunks[V any](values []V, size int) [][]V {
+	result := make([][]V, 0, (len(values)+size-1)/size)
+	for len(values) > size {
+		result = append(result, values[:size])
+		values = values[size:]
+	}
+	if len(values) > 0 {
+		result = append(result, values)
+	}
+	return result
+}
+
+// placeholders returns a comma-separated list of `n` parameter placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// discardKeys deletes the elements with the given keys from the named table,
+// using as few statements as the parameter limit allows.
+// Returns the number of elements actually removed.
+func discardKeys(ctx context.Context, tx *sql.Tx, name string, keys []any) (int64, error) {
+	var result int64
+	for _, chunk := range chunks(keys, maxParameters) {
+		execResult, err := tx.ExecContext(
+			ctx,
+			fmt.Sprintf("DELETE FROM \"%v\" WHERE k IN (%v)", name, placeholders(len(chunk))),
+			chunk...,
+		)
+		if err != nil {
+			return -1, err
+		}
+		ra, err := execResult.RowsAffected()
+		if err != nil {
+			return -1, err
+		}
+		result += ra
+	}
+	return result, nil
+}
+
+// prepare returns a prepared statement for `query` on the writer,
+// reusing it if it has been prepared before. It is cached along with
+// the named set, which must be the only one it refers to, so that it can
+// be discarded by forgetStatements.
+func (b *Bigset[T]) prepare(ctx context.Context, name, query string) (*sql.Stmt, error) {
+	b.mu.RLock()
+	stmt, exists := b.statements[name][query]
+	b.mu.RUnlock()
+	if exists {
+		return stmt, nil
+	}
+	// the lock is not held while preparing, as that may need to wait
+	// for the writer's connection
+	stmt, err := b.db.Writer().PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if existing, exists := b.statements[name][query]; exists {
+		// another caller prepared the same statement in the meantime
+		_ = stmt.Close()
+		return existing, nil
+	}
+	if b.statements[name] == nil {
+		b.statements[name] = make(map[string]*sql.Stmt)
+	}
+	b.statements[name][query] = stmt
+	return stmt, nil
+}
+
+// forgetStatements closes the cached statements which refer to the named
+// set. This must be done whenever a set is dropped or renamed, so the cache
+// does not grow without limit as sets come and go.
+func (b *Bigset[T]) forgetStatements(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, stmt := range b.statements[name] {
+		_ = stmt.Close()
+	}
+	delete(b.statements, name)
+}
@@ -1,12 +1,25 @@
 package bigset
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io/fs"
+	"iter"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nicois/fastdb"
 	"go.uber.org/zap"
@@ -18,14 +31,69 @@ type KVMapper[T any] func(*T) ([]byte, []byte, error)
 // on disk via sqlite. This reduces memory usage significantly when dealing
 // with large collections of objects.
 type Bigset[T any] struct {
-	logger   *zap.Logger
+	logger   Logger
 	filename string
 	keepFile bool
-	db       fastdb.FastDB
-	names    map[string]struct{}
-	mapper   KVMapper[T]
+	tempDir  string // where the file is created, if no filename is given
+	inMemory bool
+	// the database was provided by WithDB, so is owned by the caller
+	sharedDB bool
+	// prepended to the name of every table, as given by WithTablePrefix
+	tablePrefix string
+	ttl         time.Duration // if positive, elements expire after this long
+	// elements are numbered in the order they were added
+	insertionOrder bool
+	// each element counts how many times it has been added
+	multiplicity bool
+	wal          bool
+	readOnly     bool
+	// tables are keyed directly on k, without a separate rowid
+	withoutRowid bool
+	// sets must be created with CreateSet before they are used
+	strictSets bool
+	// iterations are read within an explicit read transaction
+	snapshotReads bool
+	// if set, elements which cannot be unmarshalled are passed to this
+	// and skipped
+	onDecodeError func(key, raw []byte, err error)
+	metrics       MetricsObserver
+	tracer        Tracer
+	// if set, this is told how far long-running operations have progressed
+	progress func(done, total int64)
+	// if positive, larger values are rejected
+	maxValueSize int
+	// additional columns stored alongside each element
+	extraColumns []ColumnSpec
+	extract      func(*T) []any
+	// if set, this must match the version recorded in the database
+	schemaVersion string
+	params        url.Values
+	db            fastdb.FastDB
+	mu            sync.RWMutex // guards names, statements and filters
+	names         map[string]struct{}
+	// prepared statements, keyed by the set they refer to, then their SQL
+	statements map[string]map[string]*sql.Stmt
+	// bloom filters, keyed by set name, if WithBloomFilter is used
+	filters       map[string]*bloomFilter
+	bloomExpected int
+	bloomRate     float64
+	// the number of writes in progress, during which a filter cannot be
+	// built, as it would not include the keys they have yet to commit
+	writes atomic.Int64
+	mapper KVMapper[T]
+	// if false, the key of each element is the same as its value,
+	// so the value is not stored separately
+	customKey bool
+	// if set, elements are stored using this rather than as JSON
+	codec     *Codec[T]
+	batchSize int // rows inserted per transaction
+	// the options given to Create, so that Clone can reuse them
+	options []option[T]
 }
 
+// IdentityMapper uses the JSON encoding of an element as both its key
+// and its value. This is the default, in which case only the key is
+// stored, as the value can be read from it.
 func IdentityMapper[T any](t *T) ([]byte, []byte, error) {
 	v, err := json.Marshal(t)
 	if err != nil {
@@ -34,61 +102,672 @@ func IdentityMapper[T any](t *T) ([]byte, []byte, error) {
 	return v, v, nil
 }
 
+// KeyOf returns the key under which `value` would be stored, as given by
+// the key function.
+func (b *Bigset[T]) KeyOf(value T) ([]byte, error) {
+	k, _, err := b.mapper(&value)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// initialise creates the named set if it does not already exist,
+// unless WithStrictSets was given, in which case it must exist already.
 func (b *Bigset[T]) initialise(ctx context.Context, name string) error {
-	sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS \"%v\" (k BLOB UNIQUE, v BLOB);", name)
-	_, err := b.db.Writer().ExecContext(ctx, sql)
+	if b.strictSets {
+		return b.found(ctx, name)
+	}
+	return b.create(ctx, name)
+}
+
+func (b *Bigset[T]) create(ctx context.Context, name string) error {
+	if err := b.writable(); err != nil {
+		return err
+	}
+	_, err := b.db.Writer().ExecContext(ctx, b.createSQL(name))
 	if err == nil {
-		b.names[name] = struct{}{}
+		b.remember(name)
 	}
 	return err
 }
 
+// found returns ErrSetNotFound if WithStrictSets was given and any of
+// the named sets does not exist. Otherwise, missing sets are allowed.
+func (b *Bigset[T]) found(ctx context.Context, names ...string) error {
+	if !b.strictSets {
+		return nil
+	}
+	for _, name := range names {
+		exists, err := b.exists(ctx, name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: %v.", ErrSetNotFound, name)
+		}
+	}
+	return nil
+}
+
+// CreateSet creates an empty set, if it does not already exist.
+// Sets are created automatically when they are first written to,
+// so this is only needed with WithStrictSets.
+func (b *Bigset[T]) CreateSet(ctx context.Context, name string) error {
+	if err := verifyNames(name); err != nil {
+		return err
+	}
+	if b.known(name) {
+		return nil
+	}
+	return b.create(ctx, name)
+}
+
+// table returns the name of the table holding the named set, or of
+// one of the tables used internally.
+func (b *Bigset[T]) table(name string) string {
+	return b.tablePrefix + name
+}
+
+// createSQL returns the statement used to create the named set.
+func (b *Bigset[T]) createSQL(name string) string {
+	// the UNIQUE constraint gives an implicit index on k, which is used for
+	// lookups and joins, so no explicit index is needed.
+	columns := []string{"k BLOB UNIQUE", "v BLOB"}
+	var suffix string
+	if b.withoutRowid {
+		columns[0] = "k BLOB PRIMARY KEY"
+		suffix = " WITHOUT ROWID"
+	}
+	if b.insertionOrder {
+		columns = append([]string{"seq INTEGER PRIMARY KEY AUTOINCREMENT"}, columns...)
+	}
+	if b.ttl > 0 {
+		columns = append(columns, fmt.Sprintf("inserted_at INTEGER NOT NULL DEFAULT (%v)", nowMillis))
+	}
+	if b.multiplicity {
+		columns = append(columns, "count INTEGER NOT NULL DEFAULT 1")
+	}
+	for _, c := range b.extraColumns {
+		columns = append(columns, strings.TrimSpace(fmt.Sprintf("\"%v\" %v", c.Name, c.Type)))
+	}
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS \"%v\" (%v)%v;%v",
+		b.table(name),
+		strings.Join(columns, ", "),
+		suffix,
+		b.indexSQL(name),
+	)
+}
+
+// known returns true if the named set is known to exist.
+func (b *Bigset[T]) known(name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, exists := b.names[name]
+	return exists
+}
+
+// remember records that the named set exists.
+func (b *Bigset[T]) remember(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.names[name] = struct{}{}
+}
+
+// forget records that the named set no longer exists.
+func (b *Bigset[T]) forget(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.names, name)
+}
+
 // Cardinality returns the number of items in a set.
-func (b *Bigset[T]) Cardinality(ctx context.Context, name string) (int64, error) {
+func (b *Bigset[T]) Cardinality(ctx context.Context, name string) (n int64, err error) {
+	ctx, done := b.observe(ctx, "Cardinality", name)
+	defer done(&n)
 	if err := verifyNames(name); err != nil {
 		return -1, err
 	}
-	sql := fmt.Sprintf("SELECT COUNT(*) FROM \"%v\"", name)
+	if err := b.found(ctx, name); err != nil {
+		return -1, err
+	}
+	sql := fmt.Sprintf("SELECT COUNT(*) FROM \"%v\"%v", b.table(name), b.expiry(" WHERE "))
 	var result int64
-	err := b.db.Reader().QueryRowContext(ctx, sql, name).Scan(&result)
+	err = b.db.Reader().QueryRowContext(ctx, sql).Scan(&result)
+	if err != nil {
+		return -1, err
+	}
+	return result, nil
+}
+
+// Cardinalities returns the number of items in each of the named sets,
+// keyed by name, counting them all in a single query.
+// Sets which do not exist have a cardinality of 0, unless WithStrictSets
+// was given.
+func (b *Bigset[T]) Cardinalities(ctx context.Context, names ...string) (map[string]int64, error) {
+	if len(names) == 0 {
+		return map[string]int64{}, nil
+	}
+	if err := verifyNames(names[0], names[1:]...); err != nil {
+		return nil, err
+	}
+	if err := b.found(ctx, names...); err != nil {
+		return nil, err
+	}
+	result := make(map[string]int64, len(names))
+	var existing []any
+	for _, name := range names {
+		if _, seen := result[name]; seen {
+			continue
+		}
+		result[name] = 0
+		exists, err := b.exists(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			existing = append(existing, name)
+		}
+	}
+	for _, chunk := range chunks(existing, min(maxParameters, maxCompoundSelect)) {
+		selects := make([]string, len(chunk))
+		for i, name := range chunk {
+			selects[i] = fmt.Sprintf("SELECT ?, COUNT(*) FROM \"%v\"%v", b.table(name.(string)), b.expiry(" WHERE "))
+		}
+		rows, err := b.db.Reader().QueryContext(ctx, strings.Join(selects, " UNION ALL "), chunk...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name string
+			var count int64
+			if err := rows.Scan(&name, &count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			result[name] = count
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// CardinalityEstimate returns the approximate number of items in a set,
+// without counting them, so is much cheaper than Cardinality for large
+// sets. If the set has been analysed by ANALYZE, the number of rows
+// recorded then is returned, which may be stale if the set has changed
+// since. Otherwise, the largest rowid is returned, which overestimates
+// the size of sets which have had items removed. Expired items are
+// included. A set which does not exist has an estimate of 0.
+func (b *Bigset[T]) CardinalityEstimate(ctx context.Context, name string) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return -1, err
+	}
+	exists, err := b.exists(ctx, name)
+	if err != nil {
+		return -1, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	analysed, err := tableExists(ctx, b.db.Reader(), "sqlite_stat1")
+	if err != nil {
+		return -1, err
+	}
+	if analysed {
+		var stat string
+		err := b.db.Reader().
+			QueryRowContext(ctx, "SELECT stat FROM sqlite_stat1 WHERE tbl = ? LIMIT 1", b.table(name)).
+			Scan(&stat)
+		switch {
+		case err == nil:
+			// the first field is the number of rows
+			fields := strings.Fields(stat)
+			if len(fields) > 0 {
+				if result, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+					return result, nil
+				}
+			}
+		case !errors.Is(err, sql.ErrNoRows):
+			return -1, err
+		}
+	}
+	if b.withoutRowid {
+		// there is no rowid to estimate from
+		return b.Cardinality(ctx, name)
+	}
+	var result sql.NullInt64
+	err = b.db.Reader().
+		QueryRowContext(ctx, fmt.Sprintf("SELECT MAX(rowid) FROM \"%v\"", b.table(name))).
+		Scan(&result)
+	if err != nil {
+		return -1, err
+	}
+	return result.Int64, nil
+}
+
+// IsEmpty returns true if a set has no items, or does not exist.
+// This is cheaper than comparing Cardinality with zero, as it stops
+// at the first item rather than counting them all.
+func (b *Bigset[T]) IsEmpty(ctx context.Context, name string) (bool, error) {
+	if err := verifyNames(name); err != nil {
+		return false, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return false, err
+	}
+	exists, err := b.exists(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return true, nil
+	}
+	sql := fmt.Sprintf("SELECT NOT EXISTS(SELECT 1 FROM \"%v\"%v)", b.table(name), b.expiry(" WHERE "))
+	var result bool
+	if err := b.db.Reader().QueryRowContext(ctx, sql).Scan(&result); err != nil {
+		return false, err
+	}
+	return result, nil
+}
+
+// DiskSize returns the approximate number of bytes used to store a set.
+// If sqlite was built with the dbstat virtual table, this is the size of
+// every page used by the set and its index. Otherwise, it is the total
+// length of every stored key and value, which excludes the overhead of
+// the index and of sqlite's own bookkeeping, so underestimates the
+// space actually used.
+// A set which does not exist has a size of zero.
+func (b *Bigset[T]) DiskSize(ctx context.Context, name string) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return -1, err
+	}
+	exists, err := b.exists(ctx, name)
 	if err != nil {
 		return -1, err
 	}
+	if !exists {
+		return 0, nil
+	}
+	var result int64
+	err = b.db.Reader().QueryRowContext(
+		ctx,
+		"SELECT COALESCE(SUM(pgsize), 0) FROM dbstat WHERE name IN "+
+			"(SELECT name FROM sqlite_master WHERE tbl_name = ?)",
+		b.table(name),
+	).Scan(&result)
+	if err == nil {
+		return result, nil
+	}
+	if !strings.Contains(err.Error(), "no such table: dbstat") {
+		return -1, err
+	}
+	sql := fmt.Sprintf("SELECT COALESCE(SUM(LENGTH(k) + COALESCE(LENGTH(v), 0)), 0) FROM \"%v\"", b.table(name))
+	if err := b.db.Reader().QueryRowContext(ctx, sql).Scan(&result); err != nil {
+		return -1, err
+	}
 	return result, nil
 }
 
 // Each executes the provided function on each item of the set in turn.
 // During each iteration, the `buffer` is populated with a different value.
+// All is usually more convenient.
 func (b *Bigset[T]) Each(
 	ctx context.Context,
 	name string,
 	buffer *T,
 	f func(ctx context.Context) error,
+) (err error) {
+	if b.observed() {
+		var n int64
+		var done func(*int64)
+		ctx, done = b.observe(ctx, "Each", name)
+		defer func() {
+			if err != nil {
+				n = -1
+			}
+			done(&n)
+		}()
+		visit := f
+		f = func(ctx context.Context) error {
+			n++
+			return visit(ctx)
+		}
+	}
+	if err := verifyNames(name); err != nil {
+		return err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return err
+	}
+	if b.progress != nil {
+		total, sizeErr := b.size(ctx, name)
+		if sizeErr != nil {
+			return sizeErr
+		}
+		var visited int64
+		visit := f
+		f = func(ctx context.Context) error {
+			visited++
+			if visited%progressInterval == 0 {
+				b.progress(visited, total)
+			}
+			return visit(ctx)
+		}
+		defer func() {
+			if err == nil {
+				b.progress(visited, visited)
+			}
+		}()
+	}
+	return b.each(ctx, fmt.Sprintf("SELECT k, COALESCE(v, k) FROM \"%v\"%v", b.table(name), b.expiry(" WHERE ")), buffer, f)
+}
+
+// EachOrdered is like Each, except that items are visited in ascending
+// order of their key. As keys are stored as BLOBs, this is the lexicographic
+// byte order of the key function's output: for example, with the default
+// JSON keys, the integer 10 is visited before 9.
+func (b *Bigset[T]) EachOrdered(
+	ctx context.Context,
+	name string,
+	buffer *T,
+	f func(ctx context.Context) error,
 ) error {
 	if err := verifyNames(name); err != nil {
 		return err
 	}
-	rows, err := b.db.Reader().QueryContext(ctx, fmt.Sprintf("SELECT v FROM \"%v\"", name))
+	if err := b.found(ctx, name); err != nil {
+		return err
+	}
+	return b.each(
+		ctx,
+		fmt.Sprintf("SELECT k, COALESCE(v, k) FROM \"%v\"%v ORDER BY k", b.table(name), b.expiry(" WHERE ")),
+		buffer,
+		f,
+	)
+}
+
+// each runs the query, populating `buffer` from the second column of each
+// row in turn before calling `f`. The first column must be the key.
+// `buffer` is reset to the zero value before each row is decoded into it.
+func (b *Bigset[T]) each(
+	ctx context.Context,
+	query string,
+	buffer *T,
+	f func(ctx context.Context) error,
+	args ...any,
+) error {
+	q, release, err := b.reader(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	rows, err := q.QueryContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
-	rawRow := sql.RawBytes{}
+	rawKey, rawRow := sql.RawBytes{}, sql.RawBytes{}
 	for rows.Next() {
-		err = rows.Scan(&rawRow)
+		// stop promptly if the caller has given up, rather than
+		// continuing until the query is exhausted
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		err = rows.Scan(&rawKey, &rawRow)
 		if err != nil {
 			return err
 		}
-		err = json.Unmarshal(rawRow, buffer)
+		// unmarshalling only sets the fields present in the row, and
+		// reuses any slices and maps already in `buffer`, so nothing may
+		// be carried over from the previous row
+		var zero T
+		*buffer = zero
+		ok, err := b.decode(rawKey, rawRow, buffer)
 		if err != nil {
 			return err
 		}
+		if !ok {
+			continue
+		}
 		err = f(ctx)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return rows.Err()
+}
+
+// reader returns the connection pool to iterate over, or a snapshot if
+// WithSnapshotReads was used. `release` must be called once the iteration
+// is complete.
+func (b *Bigset[T]) reader(ctx context.Context) (q rowsQueryer, release func(), err error) {
+	if !b.snapshotReads {
+		return b.db.Reader(), func() {}, nil
+	}
+	return b.snapshot(ctx)
+}
+
+// All returns an iterator over the items of a set, for use with range.
+// Rows are read lazily, so breaking out of the loop early stops the query.
+// If an error occurs, it is yielded along with the zero value of T,
+// and iteration stops.
+func (b *Bigset[T]) All(ctx context.Context, name string) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		if err := verifyNames(name); err != nil {
+			yield(zero, err)
+			return
+		}
+		if err := b.found(ctx, name); err != nil {
+			yield(zero, err)
+			return
+		}
+		q, release, err := b.reader(ctx)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		defer release()
+		rows, err := q.QueryContext(
+			ctx,
+			fmt.Sprintf("SELECT k, COALESCE(v, k) FROM \"%v\"%v", b.table(name), b.expiry(" WHERE ")),
+		)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		defer rows.Close()
+		rawKey, rawRow := sql.RawBytes{}, sql.RawBytes{}
+		for rows.Next() {
+			if err := ctx.Err(); err != nil {
+				yield(zero, err)
+				return
+			}
+			if err := rows.Scan(&rawKey, &rawRow); err != nil {
+				yield(zero, err)
+				return
+			}
+			var buffer T
+			ok, err := b.decode(rawKey, rawRow, &buffer)
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+			if !ok {
+				continue
+			}
+			if !yield(buffer, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(zero, err)
+		}
+	}
+}
+
+// Stream sends each item of a set on the returned channel, which is closed
+// once every item has been sent. Any error is then sent on the error
+// channel, which is always closed afterwards, so it can be read once the
+// item channel is closed.
+// If `ctx` is cancelled, sending stops and ctx.Err() is reported.
+func (b *Bigset[T]) Stream(ctx context.Context, name string) (<-chan T, <-chan error) {
+	values := make(chan T)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(values)
+		for v, err := range b.All(ctx, name) {
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case values <- v:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return values, errs
+}
+
+// AllKeys returns an iterator over the keys of the items of a set,
+// without unmarshalling the items themselves. Each key may be retained,
+// as it is not reused by later iterations.
+// If an error occurs, it is yielded along with a nil key,
+// and iteration stops.
+func (b *Bigset[T]) AllKeys(ctx context.Context, name string) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		if err := verifyNames(name); err != nil {
+			yield(nil, err)
+			return
+		}
+		if err := b.found(ctx, name); err != nil {
+			yield(nil, err)
+			return
+		}
+		q, release, err := b.reader(ctx)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer release()
+		rows, err := q.QueryContext(ctx, fmt.Sprintf("SELECT k FROM \"%v\"%v", b.table(name), b.expiry(" WHERE ")))
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			var key []byte
+			if err := rows.Scan(&key); err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(key, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// EachInOrder is like Each, except that items are visited in the order
+// in which they were added. Replacing an item, such as with Supersede,
+// does not change its position. This requires WithInsertionOrder.
+func (b *Bigset[T]) EachInOrder(
+	ctx context.Context,
+	name string,
+	buffer *T,
+	f func(ctx context.Context) error,
+) error {
+	if err := verifyNames(name); err != nil {
+		return err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return err
+	}
+	if !b.insertionOrder {
+		return errors.New("EachInOrder requires WithInsertionOrder.")
+	}
+	return b.each(
+		ctx,
+		fmt.Sprintf("SELECT k, COALESCE(v, k) FROM \"%v\"%v ORDER BY seq", b.table(name), b.expiry(" WHERE ")),
+		buffer,
+		f,
+	)
+}
+
+// EachKey executes the provided function on the key of each item of the set
+// in turn, without unmarshalling the items themselves.
+// `key` is only valid until `f` returns, so must be copied if it is retained.
+func (b *Bigset[T]) EachKey(
+	ctx context.Context,
+	name string,
+	f func(ctx context.Context, key []byte) error,
+) error {
+	if err := verifyNames(name); err != nil {
+		return err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return err
+	}
+	q, release, err := b.reader(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	rows, err := q.QueryContext(ctx, fmt.Sprintf("SELECT k FROM \"%v\"%v", b.table(name), b.expiry(" WHERE ")))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	rawRow := sql.RawBytes{}
+	for rows.Next() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = rows.Scan(&rawRow); err != nil {
+			return err
+		}
+		if err = f(ctx, rawRow); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Keys returns the keys of all the items in a set.
+func (b *Bigset[T]) Keys(ctx context.Context, name string) ([][]byte, error) {
+	result := [][]byte{}
+	err := b.EachKey(ctx, name, func(ctx context.Context, key []byte) error {
+		result = append(result, bytes.Clone(key))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 // RetrieveIfExists returns the object stored in the nominated set
@@ -97,14 +776,20 @@ func (b *Bigset[T]) RetrieveIfExists(ctx context.Context, name string, t T) (*T,
 	if err := verifyNames(name); err != nil {
 		return nil, err
 	}
+	if err := b.found(ctx, name); err != nil {
+		return nil, err
+	}
 	var buffer T
 
 	key, _, err := b.mapper(&t)
 	if err != nil {
 		return nil, err
 	}
+	if ok, err := b.mayContain(ctx, name, key); err != nil || !ok {
+		return nil, err
+	}
 	rows, err := b.db.Reader().
-		QueryContext(ctx, fmt.Sprintf("SELECT v FROM \"%v\" WHERE k = ?", name), key)
+		QueryContext(ctx, fmt.Sprintf("SELECT COALESCE(v, k) FROM \"%v\" WHERE k = ?%v", b.table(name), b.expiry(" AND ")), key)
 	if err != nil {
 		return nil, err
 	}
@@ -115,78 +800,519 @@ func (b *Bigset[T]) RetrieveIfExists(ctx context.Context, name string, t T) (*T,
 		if err != nil {
 			return nil, err
 		}
-		err = json.Unmarshal(rawRow, &buffer)
+		err = b.unmarshal(rawRow, &buffer)
+		if err != nil {
+			return nil, err
+		}
+		return &buffer, nil
+	}
+	return nil, nil
+}
+
+// Contains returns true if the set has an element with the same key
+// as `value`. A set which does not exist is treated as empty.
+func (b *Bigset[T]) Contains(ctx context.Context, name string, value T) (bool, error) {
+	if err := verifyNames(name); err != nil {
+		return false, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return false, err
+	}
+	key, _, err := b.mapper(&value)
+	if err != nil {
+		return false, err
+	}
+	if ok, err := b.mayContain(ctx, name, key); err != nil || !ok {
+		return false, err
+	}
+	exists, err := b.exists(ctx, name)
+	if err != nil || !exists {
+		return false, err
+	}
+	var result bool
+	err = b.db.Reader().QueryRowContext(
+		ctx,
+		fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM \"%v\" WHERE k = ?%v)", b.table(name), b.expiry(" AND ")),
+		key,
+	).Scan(&result)
+	if err != nil {
+		return false, err
+	}
+	return result, nil
+}
+
+// RetrieveMany is like RetrieveIfExists, but looks up many objects using
+// as few queries as possible. The result has an entry for each of `values`,
+// in the same order, which is nil if there is no matching object.
+func (b *Bigset[T]) RetrieveMany(ctx context.Context, name string, values ...T) ([]*T, error) {
+	if err := verifyNames(name); err != nil {
+		return nil, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return nil, err
+	}
+	result := make([]*T, len(values))
+	exists, err := b.exists(ctx, name)
+	if err != nil || !exists {
+		return result, err
+	}
+	keys := make([]any, 0, len(values))
+	for i := range values {
+		k, _, err := b.mapper(&values[i])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	found := make(map[string]*T, len(values))
+	for _, chunk := range chunks(keys, maxParameters) {
+		rows, err := b.db.Reader().QueryContext(
+			ctx,
+			fmt.Sprintf(
+				"SELECT k, COALESCE(v, k) FROM \"%v\" WHERE k IN (%v)%v",
+				b.table(name),
+				placeholders(len(chunk)),
+				b.expiry(" AND "),
+			),
+			chunk...,
+		)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var k, v []byte
+			if err := rows.Scan(&k, &v); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			var buffer T
+			if err := b.unmarshal(v, &buffer); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			found[string(k)] = &buffer
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+	}
+	for i, k := range keys {
+		result[i] = found[string(k.([]byte))]
+	}
+	return result, nil
+}
+
+// CountPresent returns how many of `values` have the same key as an
+// element of a set, without retrieving the elements themselves.
+// Values with the same key as one another are only counted once.
+func (b *Bigset[T]) CountPresent(ctx context.Context, name string, values ...T) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return -1, err
+	}
+	exists, err := b.exists(ctx, name)
+	if err != nil {
+		return -1, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	seen := make(map[string]struct{}, len(values))
+	keys := make([]any, 0, len(values))
+	for i := range values {
+		k, _, err := b.mapper(&values[i])
+		if err != nil {
+			return -1, err
+		}
+		if _, duplicate := seen[string(k)]; duplicate {
+			continue
+		}
+		seen[string(k)] = struct{}{}
+		keys = append(keys, k)
+	}
+	var result int64
+	for _, chunk := range chunks(keys, maxParameters) {
+		var n int64
+		err := b.db.Reader().QueryRowContext(
+			ctx,
+			fmt.Sprintf(
+				"SELECT COUNT(*) FROM \"%v\" WHERE k IN (%v)%v",
+				b.table(name),
+				placeholders(len(chunk)),
+				b.expiry(" AND "),
+			),
+			chunk...,
+		).Scan(&n)
+		if err != nil {
+			return -1, err
+		}
+		result += n
+	}
+	return result, nil
+}
+
+// Get returns a pointer to a list of all the items in a set.
+// Slice should be preferred, as it returns the list itself.
+func (b *Bigset[T]) Get(ctx context.Context, name string) (*[]T, error) {
+	result, err := b.Slice(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Slice returns all the items in a set.
+// The set is counted and read within a single read transaction, so the
+// result is a consistent view of the set, even while it is being written to.
+func (b *Bigset[T]) Slice(ctx context.Context, name string) ([]T, error) {
+	if err := verifyNames(name); err != nil {
+		return nil, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return nil, err
+	}
+	conn, release, err := b.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var size int
+	err = conn.QueryRowContext(
+		ctx,
+		fmt.Sprintf("SELECT COUNT(*) FROM \"%v\"%v", b.table(name), b.expiry(" WHERE ")),
+	).Scan(&size)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.QueryContext(
+		ctx,
+		fmt.Sprintf("SELECT k, COALESCE(v, k) FROM \"%v\"%v", b.table(name), b.expiry(" WHERE ")),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return b.collect(rows, size)
+}
+
+// snapshot returns a reader connection within a read transaction, so that
+// successive queries all see the database as it was when the first began.
+// `release` must be called once it is no longer needed.
+func (b *Bigset[T]) snapshot(ctx context.Context) (conn *sql.Conn, release func(), err error) {
+	conn, err = b.db.Reader().Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	// BeginTx would take the write lock, as connections are opened with
+	// _txlock=immediate, so a deferred transaction is begun explicitly
+	if _, err := conn.ExecContext(ctx, "BEGIN DEFERRED"); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	release = func() {
+		_, _ = conn.ExecContext(context.Background(), "ROLLBACK")
+		_ = conn.Close()
+	}
+	return conn, release, nil
+}
+
+// Sample returns up to `n` randomly-chosen items from a set.
+// Sampling is done without replacement, so each item appears at most once,
+// and fewer than `n` items are returned if the set is smaller than that.
+// This requires sqlite to sort the entire set, so it is not cheap for
+// very large sets.
+func (b *Bigset[T]) Sample(ctx context.Context, name string, n int) ([]T, error) {
+	if err := verifyNames(name); err != nil {
+		return nil, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		return []T{}, nil
+	}
+	rows, err := b.db.Reader().
+		QueryContext(ctx, fmt.Sprintf(
+			"SELECT k, COALESCE(v, k) FROM \"%v\"%v ORDER BY RANDOM() LIMIT ?",
+			b.table(name),
+			b.expiry(" WHERE "),
+		), n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return b.collect(rows, n)
+}
+
+// GetPage returns up to `limit` items from a set, skipping the first `offset`.
+// Items are ordered by their key, so as long as the set is not modified
+// between calls, successive pages will neither overlap nor skip items.
+func (b *Bigset[T]) GetPage(ctx context.Context, name string, limit, offset int) ([]T, error) {
+	if err := verifyNames(name); err != nil {
+		return nil, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return nil, err
+	}
+	if limit < 1 {
+		return []T{}, nil
+	}
+	rows, err := b.db.Reader().QueryContext(
+		ctx,
+		fmt.Sprintf("SELECT k, COALESCE(v, k) FROM \"%v\"%v ORDER BY k LIMIT ? OFFSET ?", b.table(name), b.expiry(" WHERE ")),
+		limit,
+		offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return b.collect(rows, limit)
+}
+
+// collect unmarshals the second column of each remaining row into a
+// slice. The first column must be the key.
+func (b *Bigset[T]) collect(rows *sql.Rows, capacity int) ([]T, error) {
+	result := make([]T, 0, capacity)
+	rawKey, rawRow := sql.RawBytes{}, sql.RawBytes{}
+	for rows.Next() {
+		if err := rows.Scan(&rawKey, &rawRow); err != nil {
+			return nil, err
+		}
+		var buffer T
+		ok, err := b.decode(rawKey, rawRow, &buffer)
 		if err != nil {
 			return nil, err
 		}
-		return &buffer, nil
+		if ok {
+			result = append(result, buffer)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// decode unmarshals `raw`, the value stored under `key`, into `buffer`.
+// If this fails and WithSkipDecodeErrors was given, the failure is
+// reported to its callback and false is returned, so that the element
+// can be skipped. Otherwise, the error is returned.
+func (b *Bigset[T]) decode(key, raw []byte, buffer *T) (bool, error) {
+	err := b.unmarshal(raw, buffer)
+	if err == nil {
+		return true, nil
+	}
+	if b.onDecodeError == nil {
+		return false, err
+	}
+	b.onDecodeError(key, raw, err)
+	return false, nil
+}
+
+// Union adds every element of each source set to the target set.
+// The `target` set retains any additional items it originally contained,
+// and elements whose key is already present in it are left untouched.
+// Where sources store different values under the same key, the value from
+// the first source is used.
+// As with every operation, cancelling `ctx` interrupts the statement,
+// which is rolled back, rather than waiting for it to complete.
+// It returns the number of inserted elements.
+func (b *Bigset[T]) Union(ctx context.Context, target string, source ...string) (n int64, err error) {
+	ctx, done := b.observe(ctx, "Union", target)
+	defer done(&n)
+	finish := b.track()
+	defer finish(&n)
+	if err := verifyNames(target, source...); err != nil {
+		return -1, err
+	}
+	if err := b.found(ctx, source...); err != nil {
+		return -1, err
+	}
+	if !b.known(target) {
+		if err := b.initialise(ctx, target); err != nil {
+			return -1, err
+		}
+	}
+	if len(source) < 1 {
+		return 0, nil
+	}
+	defer b.forgetFilter(target)
+	return b.apply(ctx, b.unionSQL(target, source))
+}
+
+// unionSQL returns the statement used to add every element of the
+// sources to `target`. There must be at least one source.
+// Duplicates are discarded by the target's unique key as they are
+// inserted, which is faster than removing them with UNION first, as
+// BenchmarkUnionManySources shows.
+func (b *Bigset[T]) unionSQL(target string, source []string) string {
+	columns := b.columns("")
+	sqlArray := make([]string, 0, 1+len(source))
+	sqlArray = append(sqlArray, fmt.Sprintf("INSERT OR IGNORE INTO \"%v\"(%v) ", b.table(target), columns))
+	sqlArray = append(sqlArray, fmt.Sprintf("SELECT %v FROM \"%v\" ", columns, b.table(source[0])))
+	for _, sTable := range source[1:] {
+		sqlArray = append(sqlArray, fmt.Sprintf("UNION ALL SELECT %v FROM \"%v\" ", columns, b.table(sTable)))
+	}
+	return strings.Join(sqlArray, "")
+}
+
+// CopySet adds every element of `source` to `destination`, creating it
+// if required. Elements whose key is already present in `destination`
+// are left untouched.
+// It is an error for `source` not to exist.
+// Returns the number of copied elements.
+func (b *Bigset[T]) CopySet(ctx context.Context, source, destination string) (int64, error) {
+	if err := verifyNames(source, destination); err != nil {
+		return -1, err
+	}
+	exists, err := b.exists(ctx, source)
+	if err != nil {
+		return -1, err
+	}
+	if !exists {
+		return -1, fmt.Errorf("%w: %v.", ErrSetNotFound, source)
+	}
+	if !b.known(destination) {
+		if err := b.initialise(ctx, destination); err != nil {
+			return -1, err
+		}
+	}
+	sql := fmt.Sprintf(
+		"INSERT OR IGNORE INTO \"%v\"(%v) SELECT %v FROM \"%v\"",
+		b.table(destination),
+		b.columns(""),
+		b.columns(""),
+		b.table(source),
+	)
+	defer b.forgetFilter(destination)
+	return b.apply(ctx, sql)
+}
+
+// RenameSet renames a set. This is much cheaper than copying its contents.
+// It is an error for `oldName` not to exist, or for `newName` to already exist.
+func (b *Bigset[T]) RenameSet(ctx context.Context, oldName, newName string) error {
+	if err := verifyNames(oldName, newName); err != nil {
+		return err
+	}
+	if err := b.writable(); err != nil {
+		return err
+	}
+	exists, err := b.exists(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: %v.", ErrSetNotFound, oldName)
+	}
+	exists, err = b.exists(ctx, newName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%v already exists.", newName)
+	}
+	err = b.transact(ctx, func(tx *sql.Tx) error {
+		sql := fmt.Sprintf("ALTER TABLE \"%v\" RENAME TO \"%v\"", b.table(oldName), b.table(newName))
+		if _, err := tx.ExecContext(ctx, sql); err != nil {
+			return err
+		}
+		if err := b.moveIndexes(ctx, tx, oldName, newName); err != nil {
+			return err
+		}
+		return b.moveMetadata(ctx, tx, oldName, newName)
+	})
+	if err != nil {
+		return err
 	}
-	return nil, nil
+	b.forget(oldName)
+	b.forgetFilter(oldName)
+	b.forgetStatements(oldName)
+	b.remember(newName)
+	b.forgetFilter(newName)
+	b.forgetStatements(newName)
+	return nil
 }
 
-// Get returns a pointer to a list of all the items in a set
-func (b *Bigset[T]) Get(ctx context.Context, name string) (*[]T, error) {
+// DropSet removes a set entirely, along with any metadata attached to it.
+// It is not an error for the set not to exist.
+func (b *Bigset[T]) DropSet(ctx context.Context, name string) error {
 	if err := verifyNames(name); err != nil {
-		return nil, err
-	}
-	size, err := b.Cardinality(ctx, name)
-	if err != nil {
-		return nil, err
+		return err
 	}
-	result := make([]T, 0, size)
-	var buffer T
-
-	err = b.Each(ctx, name, &buffer, func(ctx context.Context) error {
-		result = append(result, buffer)
-		return nil
+	err := b.transact(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE IF EXISTS \"%v\"", b.table(name))); err != nil {
+			return err
+		}
+		return b.moveMetadata(ctx, tx, name, "")
 	})
 	if err != nil {
-		return nil, err
+		return err
 	}
+	b.forget(name)
+	b.forgetFilter(name)
+	b.forgetStatements(name)
+	return nil
+}
 
-	if int64(len(result)) > size {
-		b.logger.Warn(
-			"Set has grown during read, leading to less efficient memory usage",
-			zap.String("set name", name),
-			zap.Int64("expected size", size),
-			zap.Int("actual size", len(result)),
-		)
-	}
-	return &result, nil
+// ListSets returns the names of every set in the database, in
+// alphabetical order. Sets are included even if they are empty.
+func (b *Bigset[T]) ListSets(ctx context.Context) ([]string, error) {
+	return b.listSets(ctx, b.db.Reader())
 }
 
-// Union adds every element of each source set to the target set.
-// The `target` set retains any additional items it originally contained.
-// It returns the number of inserted elements.
-func (b *Bigset[T]) Union(ctx context.Context, target string, source ...string) (int64, error) {
-	if err := verifyNames(target, source...); err != nil {
-		return -1, err
+// listSets is like ListSets, using `q`, so that the names can be read
+// within an existing transaction.
+func (b *Bigset[T]) listSets(ctx context.Context, q rowsQueryer) ([]string, error) {
+	rows, err := q.QueryContext(
+		ctx,
+		"SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name",
+	)
+	if err != nil {
+		return nil, err
 	}
-	if _, exists := b.names[target]; !exists {
-		if err := b.initialise(ctx, target); err != nil {
-			return -1, err
+	defer rows.Close()
+	result := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
 		}
+		// skip tables belonging to something else, such as an application
+		// sharing the database, or used internally by bigset or sqlite
+		name, ok := strings.CutPrefix(name, b.tablePrefix)
+		if !ok || verifyNames(name) != nil {
+			continue
+		}
+		result = append(result, name)
 	}
-	if len(source) < 1 {
-		return 0, nil
-	}
-	sqlArray := make([]string, 0, 1+len(source))
-	sqlArray = append(sqlArray, fmt.Sprintf("INSERT INTO \"%v\" ", target))
-	sqlArray = append(sqlArray, fmt.Sprintf("SELECT k, v FROM \"%v\" ", source[0]))
-	for _, sTable := range source[1:] {
-		sqlArray = append(sqlArray, fmt.Sprintf("UNION SELECT k, v FROM \"%v\"", sTable))
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-	return b.apply(ctx, sqlArray...)
+	return result, nil
 }
 
 // Subtract removes any items from `target` which are present in at least one
 // of the `source` sets.
 // It returns the number of removed elements.
-func (b *Bigset[T]) Subtract(ctx context.Context, target string, source ...string) (int64, error) {
+func (b *Bigset[T]) Subtract(ctx context.Context, target string, source ...string) (n int64, err error) {
+	ctx, done := b.observe(ctx, "Subtract", target)
+	defer done(&n)
+	finish := b.track()
+	defer finish(&n)
 	if err := verifyNames(target, source...); err != nil {
 		return -1, err
 	}
-	if _, exists := b.names[target]; !exists {
+	if err := b.found(ctx, source...); err != nil {
+		return -1, err
+	}
+	if !b.known(target) {
 		if err := b.initialise(ctx, target); err != nil {
 			return -1, err
 		}
@@ -197,8 +1323,7 @@ func (b *Bigset[T]) Subtract(ctx context.Context, target string, source ...strin
 	}
 	var result int64
 	for _, sTable := range source {
-		sql := fmt.Sprintf("DELETE FROM \"%v\" WHERE k IN (SELECT k FROM \"%v\")", target, sTable)
-		n, err := b.apply(ctx, sql)
+		n, err := b.apply(ctx, b.subtractSQL(target, sTable))
 		if err != nil {
 			return -1, err
 		}
@@ -207,45 +1332,252 @@ func (b *Bigset[T]) Subtract(ctx context.Context, target string, source ...strin
 	return result, nil
 }
 
+// subtractSQL returns the statement used to remove the elements of
+// `source` from `target`.
+func (b *Bigset[T]) subtractSQL(target, source string) string {
+	return fmt.Sprintf("DELETE FROM \"%v\" WHERE k IN (SELECT k FROM \"%v\")", b.table(target), b.table(source))
+}
+
 // Intersection adds elements to `target` which are present in every source set.
 // Any elements already present in `target` are retained, regardless of whether they
 // are also in the source sets.
+// Where sources store different values under the same key, the value from the
+// first source is used; IntersectionFrom allows a different source to be chosen.
 // Returns the number of added elements.
 func (b *Bigset[T]) Intersection(
 	ctx context.Context,
 	target string,
 	source ...string,
 ) (int64, error) {
+	if len(source) < 1 {
+		if err := verifyNames(target); err != nil {
+			return -1, err
+		}
+		if !b.known(target) {
+			if err := b.initialise(ctx, target); err != nil {
+				return -1, err
+			}
+		}
+		return 0, nil
+	}
+	return b.IntersectionFrom(ctx, target, source[0], source...)
+}
+
+// IntersectionFrom is like Intersection, except that the value of each added
+// element is taken from `valueSource`, which must be one of the sources.
+func (b *Bigset[T]) IntersectionFrom(
+	ctx context.Context,
+	target string,
+	valueSource string,
+	source ...string,
+) (n int64, err error) {
+	ctx, done := b.observe(ctx, "Intersection", target)
+	defer done(&n)
+	finish := b.track()
+	defer finish(&n)
+	if err := verifyNames(target, source...); err != nil {
+		return -1, err
+	}
+	if err := b.found(ctx, source...); err != nil {
+		return -1, err
+	}
+	if !slices.Contains(source, valueSource) {
+		return -1, fmt.Errorf("%v is not one of the sources.", valueSource)
+	}
+	if !b.known(target) {
+		if err := b.initialise(ctx, target); err != nil {
+			return -1, err
+		}
+	}
+	defer b.forgetFilter(target)
+	return b.apply(ctx, b.intersectionSQL(target, valueSource, source))
+}
+
+// intersectionSQL returns the statement used to add the elements present
+// in every source to `target`, taking their values from `valueSource`.
+// There must be at least one source.
+func (b *Bigset[T]) intersectionSQL(target, valueSource string, source []string) string {
+	sqlArray := make([]string, 0, len(source))
+	sqlArray = append(
+		sqlArray,
+		fmt.Sprintf(
+			"INSERT INTO \"%v\"(%v) SELECT %v FROM \"%v\" ",
+			b.table(target),
+			b.columns(""),
+			b.columns(valueSource),
+			b.table(source[0]),
+		),
+	)
+	for _, sTable := range source[1:] {
+		sqlArray = append(sqlArray, fmt.Sprintf("INNER JOIN \"%v\" USING (k)", b.table(sTable)))
+	}
+	return strings.Join(sqlArray, "")
+}
+
+// IntersectInPlace removes any items from `target` which are not present
+// in every one of the `source` sets, leaving their intersection.
+// It returns the number of removed elements.
+func (b *Bigset[T]) IntersectInPlace(
+	ctx context.Context,
+	target string,
+	source ...string,
+) (n int64, err error) {
+	ctx, done := b.observe(ctx, "IntersectInPlace", target)
+	defer done(&n)
+	finish := b.track()
+	defer finish(&n)
 	if err := verifyNames(target, source...); err != nil {
 		return -1, err
 	}
-	if _, exists := b.names[target]; !exists {
+	if err := b.found(ctx, source...); err != nil {
+		return -1, err
+	}
+	if !b.known(target) {
 		if err := b.initialise(ctx, target); err != nil {
 			return -1, err
 		}
+		return 0, nil
 	}
 	if len(source) < 1 {
 		return 0, nil
 	}
 	sqlArray := make([]string, 0, len(source))
+	sqlArray = append(
+		sqlArray,
+		fmt.Sprintf("DELETE FROM \"%v\" WHERE k NOT IN (SELECT k FROM \"%v\")", b.table(target), b.table(source[0])),
+	)
+	for _, sTable := range source[1:] {
+		sqlArray = append(sqlArray, fmt.Sprintf(" OR k NOT IN (SELECT k FROM \"%v\")", b.table(sTable)))
+	}
+	return b.apply(ctx, sqlArray...)
+}
+
+// Difference adds elements to `target` which are present in `source` but
+// not in any of the `subtract` sets. Unlike Subtract, `source` is unchanged.
+// Any elements already present in `target` are retained.
+// As with DifferenceCardinality, a set which does not exist is treated as
+// empty.
+// Returns the number of added elements.
+func (b *Bigset[T]) Difference(
+	ctx context.Context,
+	target, source string,
+	subtract ...string,
+) (n int64, err error) {
+	ctx, done := b.observe(ctx, "Difference", target)
+	defer done(&n)
+	finish := b.track()
+	defer finish(&n)
+	if err := verifyNames(target, append([]string{source}, subtract...)...); err != nil {
+		return -1, err
+	}
+	if err := b.found(ctx, append([]string{source}, subtract...)...); err != nil {
+		return -1, err
+	}
+	if !b.known(target) {
+		if err := b.initialise(ctx, target); err != nil {
+			return -1, err
+		}
+	}
+	exists, err := b.exists(ctx, source)
+	if err != nil {
+		return -1, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	sqlArray := make([]string, 0, 1+len(subtract))
 	sqlArray = append(
 		sqlArray,
 		fmt.Sprintf(
-			"INSERT INTO \"%v\" SELECT k, \"%v\".v FROM \"%v\" ",
-			target,
-			source[0],
-			source[0],
+			"INSERT OR IGNORE INTO \"%v\"(%v) SELECT %v FROM \"%v\"",
+			b.table(target),
+			b.columns(""),
+			b.columns(""),
+			b.table(source),
 		),
 	)
-	for _, sTable := range source[1:] {
-		sqlArray = append(sqlArray, fmt.Sprintf("INNER JOIN \"%v\" USING (k)", sTable))
+	conjunction := " WHERE"
+	for _, sTable := range subtract {
+		exists, err := b.exists(ctx, sTable)
+		if err != nil {
+			return -1, err
+		}
+		if !exists {
+			continue
+		}
+		sqlArray = append(
+			sqlArray,
+			fmt.Sprintf("%v k NOT IN (SELECT k FROM \"%v\")", conjunction, b.table(sTable)),
+		)
+		conjunction = " AND"
 	}
+	defer b.forgetFilter(target)
 	return b.apply(ctx, sqlArray...)
 }
 
+// UnionSlice returns the union of the sources, as Union followed by Slice
+// would, without keeping the result as a set.
+func (b *Bigset[T]) UnionSlice(ctx context.Context, source ...string) ([]T, error) {
+	return b.sliceOf(ctx, func(target string) (int64, error) {
+		return b.Union(ctx, target, source...)
+	})
+}
+
+// IntersectionSlice returns the intersection of the sources, as
+// Intersection followed by Slice would, without keeping the result as a set.
+func (b *Bigset[T]) IntersectionSlice(ctx context.Context, source ...string) ([]T, error) {
+	return b.sliceOf(ctx, func(target string) (int64, error) {
+		return b.Intersection(ctx, target, source...)
+	})
+}
+
+// DifferenceSlice returns the elements of `source` which are not present in
+// any of the `subtract` sets, as Difference followed by Slice would, without
+// keeping the result as a set.
+func (b *Bigset[T]) DifferenceSlice(ctx context.Context, source string, subtract ...string) ([]T, error) {
+	return b.sliceOf(ctx, func(target string) (int64, error) {
+		return b.Difference(ctx, target, source, subtract...)
+	})
+}
+
+// temporarySets is used to give each temporary set a unique name.
+var temporarySets atomic.Int64
+
+// temporaryName returns a name for a temporary set. It includes the
+// process ID, so it does not collide with those of other processes using
+// the same database file.
+func temporaryName() string {
+	return fmt.Sprintf("bigset-temporary-%v-%v", os.Getpid(), temporarySets.Add(1))
+}
+
+// sliceOf calls `operation` to populate a temporary set, returning its
+// contents. The set is dropped afterwards, even if the operation fails.
+func (b *Bigset[T]) sliceOf(ctx context.Context, operation func(target string) (int64, error)) ([]T, error) {
+	target := temporaryName()
+	defer func() {
+		if err := b.DropSet(context.WithoutCancel(ctx), target); err != nil {
+			b.logger.Warn("unable to drop temporary set", "name", target, "error", err)
+		}
+	}()
+	// the set is created here, as WithStrictSets would otherwise
+	// prevent the operation from creating it
+	if err := b.create(ctx, target); err != nil {
+		return nil, err
+	}
+	if _, err := operation(target); err != nil {
+		return nil, err
+	}
+	return b.Slice(ctx, target)
+}
+
 func (b *Bigset[T]) apply(ctx context.Context, sqlArray ...string) (int64, error) {
+	if err := b.writable(); err != nil {
+		return -1, err
+	}
 	sql := strings.Join(sqlArray, "")
+	b.writes.Add(1)
 	result, err := b.db.Writer().ExecContext(ctx, sql)
+	b.writes.Add(-1)
 	if err != nil {
 		return -1, err
 	}
@@ -256,131 +1588,530 @@ func (b *Bigset[T]) apply(ctx context.Context, sqlArray ...string) (int64, error
 	return ra, nil
 }
 
-// Discard removes elements from a set, if present.
-// Returns the number of elements actually removed.
-func (b *Bigset[T]) Discard(ctx context.Context, name string, values ...T) (int64, error) {
+// Discard removes elements from a set, if present.
+// Returns the number of elements actually removed.
+func (b *Bigset[T]) Discard(ctx context.Context, name string, values ...T) (int64, error) {
+	return b.DiscardSlice(ctx, name, values)
+}
+
+// DiscardSlice is like Discard, but takes the elements as a slice.
+func (b *Bigset[T]) DiscardSlice(ctx context.Context, name string, values []T) (n int64, err error) {
+	ctx, done := b.observe(ctx, "Discard", name)
+	defer done(&n)
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if !b.known(name) {
+		if err := b.initialise(ctx, name); err != nil {
+			return -1, err
+		}
+	}
+	keys := make([]any, 0, len(values))
+	for i := range values {
+		k, _, err := b.mapper(&values[i])
+		if err != nil {
+			return -1, err
+		}
+		keys = append(keys, k)
+	}
+	var result int64
+	err = b.transact(ctx, func(tx *sql.Tx) error {
+		var err error
+		result, err = discardKeys(ctx, tx, b.table(name), keys)
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+	return result, nil
+}
+
+// Pop removes an arbitrary element from a set, returning it.
+// Returns nil if the set is empty.
+func (b *Bigset[T]) Pop(ctx context.Context, name string) (*T, error) {
+	result, err := b.PopN(ctx, name, 1)
+	if err != nil || len(result) == 0 {
+		return nil, err
+	}
+	return &result[0], nil
+}
+
+// PopN removes up to `n` arbitrary elements from a set, returning them.
+// The selection and removal happen in a single statement, so concurrent
+// callers will never receive the same element.
+func (b *Bigset[T]) PopN(ctx context.Context, name string, n int) ([]T, error) {
+	if err := verifyNames(name); err != nil {
+		return nil, err
+	}
+	if err := b.writable(); err != nil {
+		return nil, err
+	}
+	if !b.known(name) {
+		if err := b.initialise(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	if n < 1 {
+		return []T{}, nil
+	}
+	sql := fmt.Sprintf(
+		"DELETE FROM \"%v\" WHERE k IN (SELECT k FROM \"%v\"%v LIMIT ?) RETURNING k, COALESCE(v, k)",
+		b.table(name),
+		b.table(name),
+		b.expiry(" WHERE "),
+	)
+	rows, err := b.db.Writer().QueryContext(ctx, sql, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return b.collect(rows, n)
+}
+
+// Add inserts elements into a set, unless an element with the
+// same key value already exists.
+// Returns the number of elements actually added.
+func (b *Bigset[T]) Add(ctx context.Context, name string, values ...T) (int64, error) {
+	return b.AddSlice(ctx, name, values)
+}
+
+// AddSlice is like Add, but takes the elements as a slice.
+func (b *Bigset[T]) AddSlice(ctx context.Context, name string, values []T) (n int64, err error) {
+	ctx, done := b.observe(ctx, "Add", name)
+	defer done(&n)
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	return b.add(ctx, b.newAddBatch(name), values...)
+}
+
+// AddOne inserts a single element into a set, unless an element with the
+// same key value already exists.
+// Returns true if the element was actually added.
+func (b *Bigset[T]) AddOne(ctx context.Context, name string, value T) (bool, error) {
+	n, err := b.Add(ctx, name, value)
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// AddReturning inserts elements into a set in the same manner as Add,
+// but returns the elements which were actually added, rather than
+// just how many there were.
+func (b *Bigset[T]) AddReturning(ctx context.Context, name string, values ...T) ([]T, error) {
+	if err := verifyNames(name); err != nil {
+		return nil, err
+	}
+	if !b.known(name) {
+		if err := b.initialise(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	batch := b.newAddBatch(name)
+	defer batch.rollback()
+	result := make([]T, 0, len(values))
+	for i := range values {
+		n, err := batch.add(ctx, &values[i])
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			result = append(result, values[i])
+		}
+	}
+	if err := batch.commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// AddStrict inserts elements into a set, like Add, but if any of them has
+// the same key as an element already in the set, or as another of
+// `values`, none are added and ErrDuplicateKey is returned, identifying
+// the first such key. This suits sets where duplicates indicate a bug.
+func (b *Bigset[T]) AddStrict(ctx context.Context, name string, values ...T) error {
+	if err := verifyNames(name); err != nil {
+		return err
+	}
+	if !b.known(name) {
+		if err := b.initialise(ctx, name); err != nil {
+			return err
+		}
+	}
+	added := make([][]byte, 0, len(values))
+	err := b.transact(ctx, func(tx *sql.Tx) error {
+		// an expired element is replaced rather than conflicting, so the
+		// statement used by Add is reused, with a conflict detected by
+		// nothing having been written
+		stmt, err := tx.PrepareContext(ctx, b.addSQL(name))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for i := range values {
+			k, args, err := b.row(&values[i])
+			if err != nil {
+				return err
+			}
+			execResult, err := stmt.ExecContext(ctx, args...)
+			if err != nil {
+				return err
+			}
+			ra, err := execResult.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if ra == 0 {
+				return fmt.Errorf("%w: %v is already in %v.", ErrDuplicateKey, describeKey(k), name)
+			}
+			added = append(added, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range added {
+		b.filterAdd(name, k)
+	}
+	return nil
+}
+
+// addSQL returns the statement used to add an element to the named set.
+func (b *Bigset[T]) addSQL(name string) string {
+	if b.ttl > 0 {
+		// an expired element is replaced, as if it had been purged
+		var count string
+		if b.multiplicity {
+			count = ", count = 1"
+		}
+		return fmt.Sprintf(
+			"INSERT INTO \"%v\"(%v) VALUES (%v) ON CONFLICT (k) DO UPDATE "+
+				"SET v = excluded.v, inserted_at = excluded.inserted_at%v%v WHERE NOT (%v);",
+			b.table(name),
+			b.columns(""),
+			b.placeholders(),
+			count,
+			b.extraAssignments(true),
+			b.unexpired(fmt.Sprintf("\"%v\".inserted_at", b.table(name))),
+		)
+	}
+	return fmt.Sprintf(
+		"INSERT INTO \"%v\"(%v) VALUES (%v) ON CONFLICT (k) DO NOTHING;",
+		b.table(name),
+		b.columns(""),
+		b.placeholders(),
+	)
+}
+
+// Supersede inserts elements into a set, replacing existing
+// elements with the same key value.
+// Returns the number of elements added or updated.
+func (b *Bigset[T]) Supersede(ctx context.Context, name string, values ...T) (int64, error) {
+	return b.SupersedeSlice(ctx, name, values)
+}
+
+// SupersedeSlice is like Supersede, but takes the elements as a slice.
+func (b *Bigset[T]) SupersedeSlice(ctx context.Context, name string, values []T) (n int64, err error) {
+	ctx, done := b.observe(ctx, "Supersede", name)
+	defer done(&n)
 	if err := verifyNames(name); err != nil {
 		return -1, err
 	}
-	if _, exists := b.names[name]; !exists {
-		if err := b.initialise(ctx, name); err != nil {
-			return -1, err
-		}
+	return b.add(ctx, b.newBatch(name, b.supersedeSQL(name)), values...)
+}
+
+// supersedeSQL returns the statement used to add or replace an element
+// in the named set.
+func (b *Bigset[T]) supersedeSQL(name string) string {
+	if b.ttl > 0 {
+		// the replacement expires as if it were newly added
+		return fmt.Sprintf(
+			"INSERT INTO \"%v\"(%v) VALUES (%v) ON CONFLICT (k) DO UPDATE "+
+				"SET v=excluded.v, inserted_at=excluded.inserted_at%v;",
+			b.table(name),
+			b.columns(""),
+			b.placeholders(),
+			b.extraAssignments(true),
+		)
 	}
-	sql := fmt.Sprintf("DELETE FROM \"%v\" WHERE k = ?", name)
-	stmt, err := b.db.Writer().PrepareContext(ctx, sql)
-	if err != nil {
+	return fmt.Sprintf(
+		"INSERT INTO \"%v\"(%v) VALUES (%v) ON CONFLICT (k) DO UPDATE SET v=excluded.v%v;",
+		b.table(name),
+		b.columns(""),
+		b.placeholders(),
+		b.extraAssignments(true),
+	)
+}
+
+// Replace discards every element of a set and adds `values` in its place,
+// as if by Add. This happens within a single transaction, so readers see
+// either the old contents or the new ones, and never an empty or
+// partially-updated set.
+// Returns the cardinality of the set once replaced.
+func (b *Bigset[T]) Replace(ctx context.Context, name string, values ...T) (n int64, err error) {
+	ctx, done := b.observe(ctx, "Replace", name)
+	defer done(&n)
+	if err := verifyNames(name); err != nil {
 		return -1, err
 	}
-	result := int64(0)
-	for _, value := range values {
-		k, _, err := b.mapper(&value)
-		if err != nil {
-			return -1, err
+	defer b.forgetFilter(name)
+	var result int64
+	err = b.WithTx(ctx, func(tx *Tx[T]) error {
+		if err := tx.initialise(ctx, name); err != nil {
+			return err
 		}
-		execResult, err := stmt.ExecContext(ctx, k)
-		if err != nil {
-			return -1, err
+		if _, err := tx.apply(ctx, fmt.Sprintf("DELETE FROM \"%v\"", b.table(name))); err != nil {
+			return err
 		}
-		ra, err := execResult.RowsAffected()
-		if err != nil {
-			return -1, err
+		if _, err := tx.Add(ctx, name, values...); err != nil {
+			return err
 		}
-		result += ra
+		var err error
+		result, err = tx.Cardinality(ctx, name)
+		return err
+	})
+	if err != nil {
+		return -1, err
 	}
 	return result, nil
 }
 
-// Add inserts elements into a set, unless an element with the
-// same key value already exists.
-// Returns the number of elements actually added.
-func (b *Bigset[T]) Add(ctx context.Context, name string, values ...T) (int64, error) {
-	sql := fmt.Sprintf("INSERT INTO \"%v\"(k, v) VALUES (?, ?) ON CONFLICT (k) DO NOTHING;", name)
-	return b.add(ctx, name, sql, values...)
-}
-
-// Supersede inserts elements into a set, replacing existing
-// elements with the same key value.
-// Returns the number of elements added or updated.
-func (b *Bigset[T]) Supersede(ctx context.Context, name string, values ...T) (int64, error) {
-	sql := fmt.Sprintf(
-		"INSERT INTO \"%v\"(k, v) VALUES (?, ?) ON CONFLICT (k) DO UPDATE SET v=excluded.v;",
-		name,
-	)
-	return b.add(ctx, name, sql, values...)
-}
-
 // Refresh replaces elements with new values, but only
 // if an element with the same key already exists.
 // Returns the number of elements actually updated.
-func (b *Bigset[T]) Refresh(ctx context.Context, name string, values ...T) (int64, error) {
+func (b *Bigset[T]) Refresh(ctx context.Context, name string, values ...T) (n int64, err error) {
+	ctx, done := b.observe(ctx, "Refresh", name)
+	defer done(&n)
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
 	// this is a bit messy as the sqlite3 params are k and v, in that order
 	sql := fmt.Sprintf(
-		"WITH x744r1xoruth AS (SELECT k, v FROM \"%v\" WHERE k = ?) UPDATE \"%v\" SET v = ? FROM x744r1xoruth WHERE \"%v\".k = x744r1xoruth.k;",
-		name,
-		name,
-		name,
+		"WITH x744r1xoruth AS (SELECT k, v FROM \"%v\" WHERE k = ?) UPDATE \"%v\" SET v = ?%v FROM x744r1xoruth WHERE \"%v\".k = x744r1xoruth.k;",
+		b.table(name),
+		b.table(name),
+		b.extraAssignments(false),
+		b.table(name),
 	)
-	return b.add(ctx, name, sql, values...)
+	return b.add(ctx, b.newBatch(name, sql), values...)
 }
 
-func (b *Bigset[T]) add(ctx context.Context, name string, sql string, values ...T) (int64, error) {
-	if err := verifyNames(name); err != nil {
+// add executes the batch's statement with the key and value of each element.
+// As the statement already contains the set's name, callers must verify it
+// before creating the batch.
+func (b *Bigset[T]) add(ctx context.Context, batch *batch[T], values ...T) (int64, error) {
+	if err := verifyNames(batch.name); err != nil {
 		return -1, err
 	}
-	if _, exists := b.names[name]; !exists {
-		if err := b.initialise(ctx, name); err != nil {
+	if !b.known(batch.name) {
+		if err := b.initialise(ctx, batch.name); err != nil {
 			return -1, err
 		}
 	}
-	stmt, err := b.db.Writer().PrepareContext(ctx, sql)
-	if err != nil {
-		return -1, err
-	}
-	result := int64(0)
-	for _, value := range values {
-		k, v, err := b.mapper(&value)
-		if err != nil {
-			return -1, err
-		}
-		execResult, err := stmt.ExecContext(ctx, k, v)
-		if err != nil {
-			return -1, err
-		}
-		ra, err := execResult.RowsAffected()
-		if err != nil {
+	defer batch.rollback()
+	for i := range values {
+		if _, err := batch.add(ctx, &values[i]); err != nil {
 			return -1, err
 		}
-		result += ra
 	}
-	return result, nil
+	if err := batch.commit(); err != nil {
+		return -1, err
+	}
+	return batch.affected, nil
 }
 
+// validName matches the names which can be used for a set.
+// As these cannot contain a colon, the tables and indexes which bigset
+// uses internally, whose names all do, can never clash with a set.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_. -]+$`)
+
+// verifyNames checks that each name can safely be interpolated into SQL.
+// A name must consist only of ASCII letters, digits, spaces, underscores,
+// periods and hyphens, and must not begin with "sqlite_", as sqlite
+// reserves such names for its own use.
 func verifyNames(name string, names ...string) error {
-	if strings.Contains(name, "\"") {
-		return fmt.Errorf("%v is not an allowable name as it contains double quotes.", name)
-	}
-	for _, name := range names {
-		if strings.Contains(name, "\"") {
-			return fmt.Errorf("%v is not an allowable name as it contains double quotes.", name)
+	for _, name := range append([]string{name}, names...) {
+		if !validName.MatchString(name) {
+			return fmt.Errorf(
+				"%w: %q may only contain letters, digits, spaces, '_', '.' and '-'.",
+				ErrInvalidName,
+				name,
+			)
+		}
+		if strings.HasPrefix(strings.ToLower(name), "sqlite_") {
+			return fmt.Errorf("%w: %q is reserved by sqlite.", ErrInvalidName, name)
 		}
 	}
 	return nil
 }
 
 // Close frees up resources used by Bigset.
-// It must not be used after being closed.
+// Once closed, other methods return ErrClosed, while closing it again
+// does nothing.
 func (b *Bigset[T]) Close() error {
+	if b.db == closedDatabase {
+		return nil
+	}
+	b.mu.Lock()
+	for name, statements := range b.statements {
+		for query, stmt := range statements {
+			if err := stmt.Close(); err != nil {
+				b.mu.Unlock()
+				return err
+			}
+			delete(statements, query)
+		}
+		delete(b.statements, name)
+	}
+	b.mu.Unlock()
+	if b.sharedDB {
+		b.db = closedDatabase
+		return nil
+	}
 	if err := b.db.Close(); err != nil {
 		return err
 	}
-	b.db = nil
-	if b.keepFile {
+	b.db = closedDatabase
+	if b.keepFile || b.readOnly || b.inMemory {
 		return nil
 	}
+	// sqlite normally removes the WAL sidecar files when the last
+	// connection is closed, but make sure nothing is left behind
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(b.filename + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
 	return os.Remove(b.filename)
 }
 
+// Backup writes a consistent copy of the entire database, including every
+// set, to `destination`. It is safe to call while other operations are
+// in progress. An error is returned if `destination` already exists.
+func (b *Bigset[T]) Backup(ctx context.Context, destination string) error {
+	if _, err := os.Stat(destination); err == nil {
+		return fmt.Errorf("%v already exists.", destination)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	_, err := b.db.Writer().ExecContext(ctx, "VACUUM INTO ?", destination)
+	return err
+}
+
+// Clone copies the entire database, including every set, to a new file
+// at `filename`, in the same manner as Backup, and returns a Bigset which
+// uses that file, with the same options as this one. The copy is kept
+// when the clone is closed, as if WithFilename had been used.
+// This Bigset is unaffected, and can continue to be used.
+// An in-memory Bigset cannot be cloned.
+func (b *Bigset[T]) Clone(ctx context.Context, filename string) (*Bigset[T], error) {
+	if b.inMemory {
+		return nil, errors.New("an in-memory Bigset cannot be cloned.")
+	}
+	if err := b.Backup(ctx, filename); err != nil {
+		return nil, err
+	}
+	result, err := build(b.logger, b.options)
+	if err != nil {
+		return nil, err
+	}
+	// the copy replaces whichever database the options would have used
+	result.db = nil
+	result.sharedDB = false
+	result.inMemory = false
+	result.filename = filename
+	result.keepFile = true
+	if err := result.connect(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Vacuum compacts the database file, returning the space freed by
+// removing elements or sets to the filesystem.
+// This rewrites the entire database, so requires up to twice its size in
+// free disk space, and blocks all other writes until it completes.
+// Readers are not blocked when the journal mode is WAL, but otherwise
+// it will wait for any outstanding reads to complete.
+func (b *Bigset[T]) Vacuum(ctx context.Context) error {
+	if err := b.writable(); err != nil {
+		return err
+	}
+	if _, err := b.db.Writer().ExecContext(ctx, "VACUUM"); err != nil {
+		return err
+	}
+	// in WAL mode, the compacted pages are only written back to the
+	// database file by a checkpoint. This is a no-op in other modes.
+	_, err := b.db.Writer().ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
+// Analyze gathers statistics about a set, which sqlite's query planner
+// uses to choose how to join sets, and which CardinalityEstimate reports.
+// Without them, operations joining many large sets, such as Intersection,
+// may be much slower than necessary. The statistics are not updated as
+// the set changes, so this is worth calling after loading or removing a
+// large number of items, before such operations are performed.
+// This reads the entire set's index, so costs about as much as
+// Cardinality, and blocks other writes until it completes.
+// A set which does not exist is ignored.
+func (b *Bigset[T]) Analyze(ctx context.Context, name string) error {
+	if err := verifyNames(name); err != nil {
+		return err
+	}
+	if err := b.writable(); err != nil {
+		return err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return err
+	}
+	exists, err := b.exists(ctx, name)
+	if err != nil || !exists {
+		return err
+	}
+	_, err = b.db.Writer().ExecContext(ctx, fmt.Sprintf("ANALYZE \"%v\"", b.table(name)))
+	return err
+}
+
+// AnalyzeAll is like Analyze, but gathers statistics about every set.
+func (b *Bigset[T]) AnalyzeAll(ctx context.Context) error {
+	if err := b.writable(); err != nil {
+		return err
+	}
+	_, err := b.db.Writer().ExecContext(ctx, "ANALYZE")
+	return err
+}
+
+// CheckIntegrity checks the entire database for corruption, such as might
+// follow a crash or a failing disk, returning true if none is found.
+// Otherwise, each problem sqlite reports is returned, up to a limit of
+// 100. This reads every page of the database, so is slow for large ones.
+func (b *Bigset[T]) CheckIntegrity(ctx context.Context) (bool, []string, error) {
+	rows, err := b.db.Reader().QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return false, nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return false, nil, err
+		}
+		problems = append(problems, line)
+	}
+	if err := rows.Err(); err != nil {
+		return false, nil, err
+	}
+	// a single row of "ok" is returned if there are no problems
+	if len(problems) == 1 && problems[0] == "ok" {
+		return true, nil, nil
+	}
+	return false, problems, nil
+}
+
 type option[T any] func(*Bigset[T]) error
 
 // WithKeyFunction allows a key function to be provided.
@@ -390,18 +2121,65 @@ type option[T any] func(*Bigset[T]) error
 // same thing, avoiding duplicates.
 // This is useful when an item has mutable attributes, for example.
 func WithKeyFunction[T any](f func(*T) []byte) option[T] {
+	return WithKeyFunctionErr(func(t *T) ([]byte, error) {
+		return f(t), nil
+	})
+}
+
+// WithKeyFunctionErr is like WithKeyFunction, but the key function can
+// fail, such as when the key is parsed from a malformed field. Its error
+// is returned by whichever operation needed the key, such as Add,
+// Discard or RetrieveIfExists.
+func WithKeyFunctionErr[T any](f func(*T) ([]byte, error)) option[T] {
 	return func(b *Bigset[T]) error {
 		b.mapper = func(t *T) ([]byte, []byte, error) {
-			_, v, err := IdentityMapper(t)
+			k, err := f(t)
+			if err != nil {
+				return nil, nil, err
+			}
+			v, err := b.marshal(t)
 			if err != nil {
 				return nil, nil, err
 			}
-			return f(t), v, nil
+			return k, v, nil
 		}
+		b.customKey = true
 		return nil
 	}
 }
 
+// WithCompositeKey is like WithKeyFunction, but builds the key from
+// several parts. Each part is prefixed with its length, so different
+// combinations of parts can never produce the same key, as they could
+// if the parts were simply concatenated.
+func WithCompositeKey[T any](parts ...func(*T) []byte) option[T] {
+	return WithKeyFunction(func(t *T) []byte {
+		var key []byte
+		for _, part := range parts {
+			p := part(t)
+			key = binary.AppendUvarint(key, uint64(len(p)))
+			key = append(key, p...)
+		}
+		return key
+	})
+}
+
+// WithHashedKey is like WithKeyFunction, but stores a hash of the key
+// returned by `extract`, such as one produced by sha256.New, instead of
+// the key itself. This keeps keys small when they would otherwise be long,
+// such as URLs. Two different keys with the same hash are treated as the
+// same key; with a cryptographic hash this is vanishingly unlikely, but
+// a weaker hash trades this guarantee for speed.
+// As keys are no longer stored verbatim, EachOrdered and GetPage
+// visit items in hash order.
+func WithHashedKey[T any](extract func(*T) []byte, h func() hash.Hash) option[T] {
+	return WithKeyFunction(func(t *T) []byte {
+		hasher := h()
+		hasher.Write(extract(t))
+		return hasher.Sum(nil)
+	})
+}
+
 // WithFilename specifies the sqlite3 file name to be used.
 // With this, the stored data will be persisted across executions.
 // No checking is done that the serialised data matches the definition of
@@ -414,12 +2192,223 @@ func WithFilename[T any](filename string) option[T] {
 	}
 }
 
+// WithTempDir specifies the directory in which the temporary database is
+// created when WithFilename is not used, instead of the default directory
+// for temporary files. It is still removed when the Bigset is closed.
+func WithTempDir[T any](dir string) option[T] {
+	return func(b *Bigset[T]) error {
+		b.tempDir = dir
+		return nil
+	}
+}
+
+// WithDB uses an existing database handle, such as one opened with
+// fastdb.Open, rather than opening a database file, so that sets can be
+// stored alongside an application's own tables. The handle remains owned
+// by the caller: Close neither closes it nor removes its file.
+// The connection parameters of the handle are used as they are, so
+// options such as WithBusyTimeout have no effect. It cannot be combined
+// with WithFilename or WithInMemory.
+func WithDB[T any](db fastdb.FastDB) option[T] {
+	return func(b *Bigset[T]) error {
+		if db == nil {
+			return errors.New("a database must be provided.")
+		}
+		b.db = db
+		b.sharedDB = true
+		return nil
+	}
+}
+
+// WithTablePrefix prepends `prefix` to the name of every table used by
+// the Bigset, so that its sets cannot collide with other tables in the
+// same database, such as when using WithDB. Set names are given and
+// returned without the prefix, and sets created with a different prefix,
+// or none, are not visible. The prefix may only contain the same
+// characters as a set name.
+func WithTablePrefix[T any](prefix string) option[T] {
+	return func(b *Bigset[T]) error {
+		if !validName.MatchString(prefix) {
+			return fmt.Errorf("%q is not a valid table prefix.", prefix)
+		}
+		b.tablePrefix = prefix
+		return nil
+	}
+}
+
+// inMemoryDatabases is used to give each in-memory database a unique name.
+var inMemoryDatabases atomic.Int64
+
+// WithInMemory keeps the database entirely in memory, rather than in a
+// temporary file, which is faster for small sets such as in tests.
+// Nothing is persisted, and the sets must fit in memory.
+// As an in-memory database cannot use the write-ahead log, reading
+// blocks writing: an operation such as Map, which reads one set while
+// writing another, fails once the busy timeout expires if it needs to
+// commit more than one batch. It cannot be combined with WithFilename
+// or WithWAL.
+func WithInMemory[T any]() option[T] {
+	return func(b *Bigset[T]) error {
+		b.inMemory = true
+		return nil
+	}
+}
+
+// WithWAL ensures the database uses sqlite's write-ahead log, which allows
+// any number of readers to proceed concurrently with a single writer.
+// The journal mode is stored in the database file itself, so a file
+// persisted using WithFilename will remain in WAL mode when reopened.
+// While open, the database is accompanied by `-wal` and `-shm` files,
+// which are removed along with a temporary database when it is closed.
+// Creation fails if the journal mode cannot be changed.
+func WithWAL[T any]() option[T] {
+	return func(b *Bigset[T]) error {
+		b.wal = true
+		return nil
+	}
+}
+
+// WithBusyTimeout sets how long an operation will wait for a lock held by
+// another connection before failing with a "database is locked" error.
+// It applies to every reader and writer connection. The default is 5 seconds,
+// which is usually sufficient; increase it if writes are long-running.
+func WithBusyTimeout[T any](d time.Duration) option[T] {
+	return func(b *Bigset[T]) error {
+		if d < 0 {
+			return fmt.Errorf("%v is not a valid busy timeout.", d)
+		}
+		b.params.Set("_busy_timeout", strconv.FormatInt(d.Milliseconds(), 10))
+		return nil
+	}
+}
+
+// WithInsertBatchSize sets how many elements are inserted per transaction
+// when adding many elements at once. Larger batches are faster, but hold
+// the write lock for longer. The default is 10000.
+func WithInsertBatchSize[T any](n int) option[T] {
+	return func(b *Bigset[T]) error {
+		if n < 1 {
+			return fmt.Errorf("%v is not a valid batch size.", n)
+		}
+		b.batchSize = n
+		return nil
+	}
+}
+
+// WithWithoutRowid creates tables as WITHOUT ROWID, with k as the primary key.
+// This avoids storing a separate index for k, reducing the size of the
+// database and speeding up lookups by key.
+// As this changes the on-disk format, sets created before this option
+// was used keep their original layout.
+func WithWithoutRowid[T any]() option[T] {
+	return func(b *Bigset[T]) error {
+		b.withoutRowid = true
+		return nil
+	}
+}
+
+// WithInsertionOrder records the order in which elements are added to
+// each set, allowing them to be visited in that order with EachInOrder.
+// This only applies to sets created while this option is in use,
+// and cannot be combined with WithWithoutRowid.
+func WithInsertionOrder[T any]() option[T] {
+	return func(b *Bigset[T]) error {
+		b.insertionOrder = true
+		return nil
+	}
+}
+
+// WithReadOnly opens an existing database, as given by WithFilename,
+// without permitting any modifications. Any attempt to modify it will
+// return ErrReadOnly. As nothing is written, several processes can safely
+// open the same file at once. The file is never removed by Close.
+func WithReadOnly[T any]() option[T] {
+	return func(b *Bigset[T]) error {
+		b.readOnly = true
+		b.params.Set("mode", "ro")
+		// these would otherwise require writing to the database
+		b.params.Del("_journal_mode")
+		b.params.Del("_txlock")
+		return nil
+	}
+}
+
+// WithStrictSets prevents sets from being created implicitly when they
+// are first written to. Instead, operations on a set which has not been
+// created with CreateSet return ErrSetNotFound, as do reads which would
+// otherwise treat it as empty. This catches mistyped set names.
+func WithStrictSets[T any]() option[T] {
+	return func(b *Bigset[T]) error {
+		b.strictSets = true
+		return nil
+	}
+}
+
+// WithSnapshotReads causes Each and the other iterations over a set, such
+// as EachOrdered, EachKey, All, AllKeys, Map and Partition, to read within an explicit read transaction, pinning a consistent snapshot
+// of the database until they finish, however long that takes.
+// Slice and Get always do so.
+// While a read transaction is open, a WAL checkpoint cannot proceed past
+// it, so the WAL file can grow without bound during a long iteration over
+// a set which is also being written to.
+func WithSnapshotReads[T any]() option[T] {
+	return func(b *Bigset[T]) error {
+		b.snapshotReads = true
+		return nil
+	}
+}
+
+// WithSkipDecodeErrors causes elements which cannot be unmarshalled, such
+// as those stored before an incompatible change to T, to be skipped when
+// reading a set with Each, All, Slice and similar methods, rather than
+// stopping with an error. Each such element is passed to `onError`, along
+// with its key and stored value, which are only valid until it returns.
+// This allows the rest of a set to be salvaged.
+func WithSkipDecodeErrors[T any](onError func(key []byte, raw []byte, err error)) option[T] {
+	return func(b *Bigset[T]) error {
+		if onError == nil {
+			return errors.New("an error callback must be provided.")
+		}
+		b.onDecodeError = onError
+		return nil
+	}
+}
+
+// WithLogger sets the logger, replacing the one passed to Create.
+// Use ZapLogger to adapt a zap logger.
+func WithLogger[T any](logger Logger) option[T] {
+	return func(b *Bigset[T]) error {
+		if logger != nil {
+			b.logger = logger
+		}
+		return nil
+	}
+}
+
 // Create creates a new Bigset.
+// If `logger` is nil, nothing is logged unless WithLogger is used.
 func Create[T any](logger *zap.Logger, options ...option[T]) (*Bigset[T], error) {
+	result, err := build(ZapLogger(logger), options)
+	if err != nil {
+		return nil, err
+	}
+	if err := result.connect(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// build returns a Bigset with the given options applied, which is not
+// yet connected to a database.
+func build[T any](logger Logger, options []option[T]) (*Bigset[T], error) {
 	result := &Bigset[T]{
-		logger: logger,
-		names:  make(map[string]struct{}, 0),
-		mapper: IdentityMapper[T],
+		logger:     logger,
+		names:      make(map[string]struct{}, 0),
+		statements: make(map[string]map[string]*sql.Stmt),
+		mapper:     IdentityMapper[T],
+		params:     defaultConnectionParams(),
+		batchSize:  defaultBatchSize,
+		options:    options,
 	}
 	for _, opt := range options {
 		err := opt(result)
@@ -427,20 +2416,72 @@ func Create[T any](logger *zap.Logger, options ...option[T]) (*Bigset[T], error)
 			return nil, err
 		}
 	}
-	if result.filename == "" {
-		tempfile, err := os.CreateTemp("", "bigset")
+	return result, nil
+}
+
+// connect opens the database given by the options, if one was not
+// provided using WithDB.
+func (b *Bigset[T]) connect() error {
+	if b.insertionOrder && b.withoutRowid {
+		return errors.New("WithInsertionOrder cannot be combined with WithWithoutRowid.")
+	}
+	if b.sharedDB {
+		if b.filename != "" || b.inMemory {
+			return errors.New("WithDB cannot be combined with WithFilename or WithInMemory.")
+		}
+		return b.configure()
+	}
+	if b.readOnly && b.filename == "" {
+		return errors.New("WithReadOnly requires WithFilename.")
+	}
+	if b.inMemory {
+		if b.filename != "" || b.wal {
+			return errors.New("WithInMemory cannot be combined with WithFilename or WithWAL.")
+		}
+		// the memdb VFS shares a database between every connection using
+		// the same name, as long as it begins with a slash
+		b.filename = fmt.Sprintf("/bigset-%v", inMemoryDatabases.Add(1))
+		b.params.Set("vfs", "memdb")
+		b.params.Del("_journal_mode")
+	}
+	if b.filename == "" {
+		tempfile, err := os.CreateTemp(b.tempDir, "bigset")
 		if err != nil {
-			return nil, err
+			return err
 		}
-		result.filename = tempfile.Name()
+		b.filename = tempfile.Name()
 		if err = tempfile.Close(); err != nil {
-			return nil, err
+			return err
 		}
 	}
-	db, err := fastdb.Open(result.filename)
+	db, err := open(b.filename, b.params)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	result.db = db
-	return result, nil
+	b.db = db
+	if err := b.configure(); err != nil {
+		_ = db.Close()
+		return err
+	}
+	return nil
+}
+
+// configure sets up a newly-opened database as required by the options.
+func (b *Bigset[T]) configure() error {
+	if b.wal {
+		var mode string
+		err := b.db.Writer().QueryRow("PRAGMA journal_mode = WAL").Scan(&mode)
+		if err == nil && !strings.EqualFold(mode, "wal") {
+			err = fmt.Errorf("unable to use WAL, as the journal mode is %v.", mode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if b.schemaVersion != "" {
+		if err := b.checkSchemaVersion(context.Background()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -2,11 +2,20 @@ package bigset_test
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/nicois/bigset"
+	"github.com/nicois/fastdb"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
@@ -29,8 +38,26 @@ func TestNames(t *testing.T) {
 
 	// disallow a name with double-quotes
 	n, err := b.Add(ctx, "fo\"o")
-	require.Error(t, err)
+	require.ErrorIs(t, err, bigset.ErrInvalidName)
+	require.Equal(t, n, int64(-1))
+
+	n, err = b.Supersede(ctx, "fo\"o", 1)
+	require.ErrorIs(t, err, bigset.ErrInvalidName)
 	require.Equal(t, n, int64(-1))
+	// nothing is created for an invalid name
+	sets, err := b.ListSets(ctx)
+	require.Nil(t, err)
+	require.Empty(t, sets)
+
+	for _, name := range []string{"", "fo\\o", "fo\x00o", "föo", "a;b", "fo`o", "sqlite_master"} {
+		_, err = b.Add(ctx, name, 1)
+		require.ErrorIs(t, err, bigset.ErrInvalidName, name)
+	}
+	for _, name := range []string{"foo", "all books", "v1.2_final-draft"} {
+		_, err = b.Add(ctx, name, 1)
+		require.Nil(t, err, name)
+	}
+	require.Nil(t, b.Close())
 }
 
 func TestRefresh(t *testing.T) {
@@ -137,6 +164,51 @@ func TestKeyFunction(t *testing.T) {
 	n, err := b.Add(ctx, "foo", 1, 2, 3, 11, 12, 13, 21, 22, 23, 31, 32, 33)
 	require.Equal(t, n, int64(3))
 	require.Nil(t, err)
+
+	k, err := b.KeyOf(21)
+	require.Nil(t, err)
+	require.Equal(t, []byte("1"), k)
+}
+
+func TestKeyFunctionErr(t *testing.T) {
+	ctx := context.Background()
+	invalid := errors.New("negative")
+	b, err := bigset.Create[int](logger, bigset.WithKeyFunctionErr(func(i *int) ([]byte, error) {
+		if *i < 0 {
+			return nil, invalid
+		}
+		return []byte(fmt.Sprint(*i % 10)), nil
+	}))
+	require.Nil(t, err)
+
+	n, err := b.Add(ctx, "foo", 1, 2, 11)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	_, err = b.Add(ctx, "foo", 3, -1)
+	require.ErrorIs(t, err, invalid)
+	_, err = b.Discard(ctx, "foo", -1)
+	require.ErrorIs(t, err, invalid)
+	_, err = b.RetrieveIfExists(ctx, "foo", -1)
+	require.ErrorIs(t, err, invalid)
+
+	n, err = b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestKeyOf(t *testing.T) {
+	b, err := bigset.Create[Book](logger)
+	require.Nil(t, err)
+
+	// by default, the key is the JSON encoding of the element
+	k, err := b.KeyOf(Book{Name: "Dune", Pages: 412})
+	require.Nil(t, err)
+	require.JSONEq(t, `{"Name":"Dune","Pages":412,"Favourite":false}`, string(k))
+
+	require.Nil(t, b.Close())
 }
 
 func TestFilename(t *testing.T) {
@@ -165,6 +237,97 @@ func TestFilename(t *testing.T) {
 	require.Nil(t, b2.Close())
 }
 
+func TestWithDB(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "shared.db")
+	db, err := fastdb.Open(filename)
+	require.Nil(t, err)
+	_, err = db.Writer().Exec("CREATE TABLE app (id INTEGER)")
+	require.Nil(t, err)
+
+	b, err := bigset.Create[int](logger, bigset.WithDB[int](db))
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+
+	// the database is still open, and contains both tables
+	var n int
+	require.Nil(t, db.Reader().QueryRow("SELECT COUNT(*) FROM foo").Scan(&n))
+	require.Equal(t, 3, n)
+	require.Nil(t, db.Reader().QueryRow("SELECT COUNT(*) FROM app").Scan(&n))
+	require.Nil(t, db.Close())
+	_, err = os.Stat(filename)
+	require.Nil(t, err)
+
+	_, err = bigset.Create[int](logger, bigset.WithDB[int](db), bigset.WithFilename[int](filename))
+	require.Error(t, err)
+}
+
+func TestTablePrefix(t *testing.T) {
+	ctx := context.Background()
+	db, err := fastdb.Open(filepath.Join(t.TempDir(), "shared.db"))
+	require.Nil(t, err)
+	_, err = db.Writer().Exec("CREATE TABLE foo (id INTEGER)")
+	require.Nil(t, err)
+
+	first, err := bigset.Create[int](logger, bigset.WithDB[int](db), bigset.WithTablePrefix[int]("first_"))
+	require.Nil(t, err)
+	second, err := bigset.Create[int](logger, bigset.WithDB[int](db), bigset.WithTablePrefix[int]("second_"))
+	require.Nil(t, err)
+
+	// sets with the same name do not collide with each other,
+	// or with the application's own table
+	_, err = first.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	_, err = second.Add(ctx, "foo", 4)
+	require.Nil(t, err)
+	n, err := first.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+	n, err = second.Union(ctx, "bar", "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+
+	sets, err := first.ListSets(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []string{"foo"}, sets)
+	sets, err = second.ListSets(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []string{"bar", "foo"}, sets)
+
+	var count int
+	require.Nil(t, db.Reader().QueryRow(`SELECT COUNT(*) FROM "first_foo"`).Scan(&count))
+	require.Equal(t, 3, count)
+
+	_, err = bigset.Create[int](logger, bigset.WithTablePrefix[int]("a\"b"))
+	require.Error(t, err)
+
+	require.Nil(t, first.Close())
+	require.Nil(t, second.Close())
+	require.Nil(t, db.Close())
+}
+
+func TestCloseTwice(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1)
+	require.Nil(t, err)
+
+	require.Nil(t, b.Close())
+	require.Nil(t, b.Close())
+
+	_, err = b.Add(ctx, "foo", 2)
+	require.ErrorIs(t, err, bigset.ErrClosed)
+	_, err = b.Cardinality(ctx, "foo")
+	require.ErrorIs(t, err, bigset.ErrClosed)
+	_, err = b.Slice(ctx, "foo")
+	require.ErrorIs(t, err, bigset.ErrClosed)
+	err = b.WithTx(ctx, func(tx *bigset.Tx[int]) error { return nil })
+	require.ErrorIs(t, err, bigset.ErrClosed)
+}
+
 func TestSomething(t *testing.T) {
 	ctx := context.Background()
 	b, err := bigset.Create[int](logger)
@@ -284,3 +447,1707 @@ func TestStructAndEach(t *testing.T) {
 
 	require.Nil(t, b.Close())
 }
+
+func TestSample(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	require.Nil(t, err)
+
+	sample, err := b.Sample(ctx, "foo", 4)
+	require.Nil(t, err)
+	require.Len(t, sample, 4)
+	seen := make(map[int]struct{})
+	for _, i := range sample {
+		require.GreaterOrEqual(t, i, 1)
+		require.LessOrEqual(t, i, 10)
+		seen[i] = struct{}{}
+	}
+	// sampling is without replacement
+	require.Len(t, seen, 4)
+
+	// asking for more than is available returns everything
+	sample, err = b.Sample(ctx, "foo", 20)
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, sample)
+
+	sample, err = b.Sample(ctx, "foo", 0)
+	require.Nil(t, err)
+	require.Len(t, sample, 0)
+
+	require.Nil(t, b.Close())
+}
+
+func TestPop(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	// popping from an empty set yields nothing
+	i, err := b.Pop(ctx, "foo")
+	require.Nil(t, err)
+	require.Nil(t, i)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3, 4, 5)
+	require.Nil(t, err)
+
+	i, err = b.Pop(ctx, "foo")
+	require.Nil(t, err)
+	require.NotNil(t, i)
+	n, err := b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(4), n)
+
+	nums, err := b.PopN(ctx, "foo", 10)
+	require.Nil(t, err)
+	require.Len(t, nums, 4)
+	require.NotContains(t, nums, *i)
+
+	n, err = b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestConcurrentPop(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	values := make([]int, 0, 100)
+	for i := range 100 {
+		values = append(values, i)
+	}
+	_, err = b.Add(ctx, "foo", values...)
+	require.Nil(t, err)
+
+	// each element must be popped exactly once
+	results := make(chan int, len(values))
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i, err := b.Pop(ctx, "foo")
+				if err != nil || i == nil {
+					return
+				}
+				results <- *i
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	popped := make([]int, 0, len(values))
+	for i := range results {
+		popped = append(popped, i)
+	}
+	require.ElementsMatch(t, values, popped)
+
+	require.Nil(t, b.Close())
+}
+
+func TestCountPresent(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	n, err := b.CountPresent(ctx, "foo", 1, 2)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	n, err = b.CountPresent(ctx, "foo", 2, 3, 4, 2, 3)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	// more values than fit in a single statement
+	values := make([]int, 0, 50000)
+	for i := range 50000 {
+		values = append(values, i%10000)
+	}
+	n, err = b.CountPresent(ctx, "foo", values...)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestGetPage(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 5, 3, 1, 4, 2)
+	require.Nil(t, err)
+
+	first, err := b.GetPage(ctx, "foo", 2, 0)
+	require.Nil(t, err)
+	require.Equal(t, []int{1, 2}, first)
+
+	second, err := b.GetPage(ctx, "foo", 2, 2)
+	require.Nil(t, err)
+	require.Equal(t, []int{3, 4}, second)
+
+	last, err := b.GetPage(ctx, "foo", 2, 4)
+	require.Nil(t, err)
+	require.Equal(t, []int{5}, last)
+
+	beyond, err := b.GetPage(ctx, "foo", 2, 6)
+	require.Nil(t, err)
+	require.Len(t, beyond, 0)
+
+	require.Nil(t, b.Close())
+}
+
+func TestEachOrdered(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 9, 2, 10, 1)
+	require.Nil(t, err)
+
+	var buffer int
+	visited := make([]int, 0, 4)
+	err = b.EachOrdered(ctx, "foo", &buffer, func(ctx context.Context) error {
+		visited = append(visited, buffer)
+		return nil
+	})
+	require.Nil(t, err)
+	// keys are compared bytewise, so "10" sorts before "2"
+	require.Equal(t, []int{1, 10, 2, 9}, visited)
+
+	require.Nil(t, b.Close())
+}
+
+func TestBackup(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "bar", 4)
+	require.Nil(t, err)
+
+	destination := filepath.Join(t.TempDir(), "backup")
+	require.Nil(t, b.Backup(ctx, destination))
+
+	// refuse to overwrite an existing file
+	require.Error(t, b.Backup(ctx, destination))
+	require.Nil(t, b.Close())
+
+	restored, err := bigset.Create[int](logger, bigset.WithFilename[int](destination))
+	require.Nil(t, err)
+	n, err := restored.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+	n, err = restored.Cardinality(ctx, "bar")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+	require.Nil(t, restored.Close())
+}
+
+func TestClone(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger, bigset.WithTablePrefix[int]("x_"))
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+
+	destination := filepath.Join(t.TempDir(), "clone")
+	clone, err := b.Clone(ctx, destination)
+	require.Nil(t, err)
+
+	// the two diverge once cloned
+	_, err = clone.Add(ctx, "foo", 4)
+	require.Nil(t, err)
+	_, err = b.Discard(ctx, "foo", 1)
+	require.Nil(t, err)
+	values, err := clone.Slice(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 2, 3, 4}, values)
+	values, err = b.Slice(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{2, 3}, values)
+
+	// the copy is kept once the clone is closed
+	require.Nil(t, clone.Close())
+	_, err = os.Stat(destination)
+	require.Nil(t, err)
+	_, err = b.Clone(ctx, destination)
+	require.Error(t, err)
+
+	require.Nil(t, b.Close())
+
+	// an in-memory database cannot be copied to a file
+	b, err = bigset.Create[int](logger, bigset.WithInMemory[int]())
+	require.Nil(t, err)
+	_, err = b.Clone(ctx, filepath.Join(t.TempDir(), "clone"))
+	require.Error(t, err)
+	require.Nil(t, b.Close())
+}
+
+func TestCopySet(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+
+	n, err := b.CopySet(ctx, "foo", "bar")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	// merge into a set which already has some of the elements
+	_, err = b.Add(ctx, "baz", 3, 4)
+	require.Nil(t, err)
+	n, err = b.CopySet(ctx, "foo", "baz")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	nums, err := b.Get(ctx, "baz")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 2, 3, 4}, *nums)
+
+	// the source must exist
+	_, err = b.CopySet(ctx, "missing", "bar")
+	require.ErrorIs(t, err, bigset.ErrSetNotFound)
+
+	require.Nil(t, b.Close())
+}
+
+func TestUnionOverlapping(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Versioned](logger, bigset.WithKeyFunction(versionedKey))
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "first", Versioned{ID: "a", Version: 1}, Versioned{ID: "b", Version: 1})
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "second", Versioned{ID: "a", Version: 2}, Versioned{ID: "c", Version: 2})
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "target", Versioned{ID: "c", Version: 3})
+	require.Nil(t, err)
+
+	// the target's elements are kept, then the first source's
+	n, err := b.Union(ctx, "target", "first", "second")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+	values, err := b.Get(ctx, "target")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []Versioned{
+		{ID: "a", Version: 1},
+		{ID: "b", Version: 1},
+		{ID: "c", Version: 3},
+	}, *values)
+
+	require.Nil(t, b.Close())
+}
+
+func TestUnionCancellation(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+	values := make([]int, 50000)
+	for i := range values {
+		values[i] = i
+	}
+	_, err = b.AddSlice(ctx, "foo", values)
+	require.Nil(t, err)
+	sources := make([]string, 64)
+	for i := range sources {
+		sources[i] = "foo"
+	}
+
+	// the statement is interrupted, rather than running to completion
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = b.Union(timeout, "bar", sources...)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 200*time.Millisecond)
+
+	// and nothing was added
+	n, err := b.Cardinality(ctx, "bar")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestRenameSet(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "tmp", 1, 2, 3)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "taken", 4)
+	require.Nil(t, err)
+
+	require.Nil(t, b.RenameSet(ctx, "tmp", "result"))
+	n, err := b.Cardinality(ctx, "result")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	_, err = b.Cardinality(ctx, "tmp")
+	require.Error(t, err)
+
+	// the old name can be reused
+	n, err = b.Add(ctx, "tmp", 5)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+	n, err = b.Add(ctx, "result", 3, 6)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+
+	// as can the name of a dropped set
+	require.Nil(t, b.DropSet(ctx, "tmp"))
+	n, err = b.Add(ctx, "tmp", 5, 6)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	require.Error(t, b.RenameSet(ctx, "result", "taken"))
+	require.ErrorIs(t, b.RenameSet(ctx, "missing", "other"), bigset.ErrSetNotFound)
+
+	require.Nil(t, b.Close())
+}
+
+func TestAddOne(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	added, err := b.AddOne(ctx, "foo", 1)
+	require.Nil(t, err)
+	require.True(t, added)
+
+	added, err = b.AddOne(ctx, "foo", 1)
+	require.Nil(t, err)
+	require.False(t, added)
+
+	require.Nil(t, b.Close())
+}
+
+func TestIntersectInPlace(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "working", 1, 2, 3, 4, 5, 6)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "even", 2, 4, 6, 8)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "small", 1, 2, 3, 4)
+	require.Nil(t, err)
+
+	// no sources is a no-op
+	n, err := b.IntersectInPlace(ctx, "working")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+
+	n, err = b.IntersectInPlace(ctx, "working", "even", "small")
+	require.Nil(t, err)
+	require.Equal(t, int64(4), n)
+
+	nums, err := b.Get(ctx, "working")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{2, 4}, *nums)
+
+	require.Nil(t, b.Close())
+}
+
+func TestDifference(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "a", 1, 2, 3, 4, 5)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "b", 1, 2)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "c", 5, 6)
+	require.Nil(t, err)
+
+	n, err := b.Difference(ctx, "result", "a", "b", "c")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	nums, err := b.Get(ctx, "result")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{3, 4}, *nums)
+
+	// the source is untouched
+	n, err = b.Cardinality(ctx, "a")
+	require.Nil(t, err)
+	require.Equal(t, int64(5), n)
+
+	// with nothing to subtract, everything is copied
+	n, err = b.Difference(ctx, "copy", "a")
+	require.Nil(t, err)
+	require.Equal(t, int64(5), n)
+
+	// missing sets are treated as empty
+	n, err = b.Difference(ctx, "partial", "a", "b", "missing")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+	n, err = b.Difference(ctx, "none", "missing", "a")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+	values, err := b.DifferenceSlice(ctx, "a", "missing", "c")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 2, 3, 4}, values)
+	n, err = b.DifferenceCardinality(ctx, "a", "missing", "c")
+	require.Nil(t, err)
+	require.Equal(t, int64(4), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestOperationSlices(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "a", 1, 2, 3, 4)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "b", 3, 4, 5)
+	require.Nil(t, err)
+
+	values, err := b.IntersectionSlice(ctx, "a", "b")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{3, 4}, values)
+	values, err = b.UnionSlice(ctx, "a", "b")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 2, 3, 4, 5}, values)
+	values, err = b.DifferenceSlice(ctx, "a", "b")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 2}, values)
+	_, err = b.UnionSlice(ctx, "a", "bad\"name")
+	require.Error(t, err)
+
+	// the temporary sets are dropped
+	names, err := b.ListSets(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "b"}, names)
+
+	// concurrent calls do not interfere with each other
+	results := make(chan []int, 8)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			values, err := b.IntersectionSlice(ctx, "a", "b")
+			if err == nil {
+				results <- values
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	require.Len(t, results, 8)
+	for values := range results {
+		require.ElementsMatch(t, []int{3, 4}, values)
+	}
+
+	require.Nil(t, b.Close())
+
+	// the temporary set does not need to exist beforehand in strict mode
+	b, err = bigset.Create[int](logger, bigset.WithStrictSets[int]())
+	require.Nil(t, err)
+	require.Nil(t, b.CreateSet(ctx, "a"))
+	_, err = b.Add(ctx, "a", 1, 2)
+	require.Nil(t, err)
+	values, err = b.UnionSlice(ctx, "a")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 2}, values)
+	_, err = b.UnionSlice(ctx, "a", "missing")
+	require.ErrorIs(t, err, bigset.ErrSetNotFound)
+
+	require.Nil(t, b.Close())
+}
+
+func TestEachCancellation(t *testing.T) {
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	values := make([]int, 0, 1000)
+	for i := range 1000 {
+		values = append(values, i)
+	}
+	_, err = b.Add(context.Background(), "foo", values...)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var buffer int
+	visited := 0
+	err = b.Each(ctx, "foo", &buffer, func(ctx context.Context) error {
+		visited++
+		if visited == 10 {
+			cancel()
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 10, visited)
+
+	_, err = b.Get(ctx, "foo")
+	require.ErrorIs(t, err, context.Canceled)
+
+	require.Nil(t, b.Close())
+}
+
+func TestWAL(t *testing.T) {
+	ctx := context.Background()
+	// isolate the temporary file so it can be checked for leftovers
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	b, err := bigset.Create[int](logger, bigset.WithWAL[int]())
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	matches, err := filepath.Glob(filepath.Join(dir, "bigset*-wal"))
+	require.Nil(t, err)
+	require.Len(t, matches, 1)
+
+	require.Nil(t, b.Close())
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, entries, 0)
+}
+
+func TestBusyTimeout(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "busy")
+	b, err := bigset.Create[int](
+		logger,
+		bigset.WithFilename[int](filename),
+		bigset.WithBusyTimeout[int](50*time.Millisecond),
+	)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1)
+	require.Nil(t, err)
+
+	// hold the write lock from another connection
+	other, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	tx, err := other.BeginTx(ctx, nil)
+	require.Nil(t, err)
+	_, err = tx.ExecContext(ctx, "INSERT INTO foo(k, v) VALUES ('x', 'x')")
+	require.Nil(t, err)
+
+	start := time.Now()
+	_, err = b.Add(ctx, "foo", 2)
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 2*time.Second)
+
+	require.Nil(t, tx.Rollback())
+	require.Nil(t, other.Close())
+	require.Nil(t, b.Close())
+
+	_, err = bigset.Create[int](logger, bigset.WithBusyTimeout[int](-time.Second))
+	require.Error(t, err)
+}
+
+func TestInsertBatchSize(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger, bigset.WithInsertBatchSize[int](2))
+	require.Nil(t, err)
+
+	// spans several transactions
+	n, err := b.Add(ctx, "foo", 1, 2, 3, 4, 5, 1)
+	require.Nil(t, err)
+	require.Equal(t, int64(5), n)
+
+	n, err = b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(5), n)
+	require.Nil(t, b.Close())
+
+	_, err = bigset.Create[int](logger, bigset.WithInsertBatchSize[int](0))
+	require.Error(t, err)
+}
+
+func TestAddStrict(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	require.Nil(t, b.AddStrict(ctx, "foo", 1, 2, 3))
+
+	// a conflict with an existing element adds nothing
+	err = b.AddStrict(ctx, "foo", 4, 2, 5)
+	require.ErrorIs(t, err, bigset.ErrDuplicateKey)
+	require.ErrorContains(t, err, `"2"`)
+	// as does a conflict between the new elements
+	err = b.AddStrict(ctx, "foo", 6, 7, 6)
+	require.ErrorIs(t, err, bigset.ErrDuplicateKey)
+	require.ErrorContains(t, err, `"6"`)
+
+	n, err := b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestAddReturning(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 2, 4)
+	require.Nil(t, err)
+
+	added, err := b.AddReturning(ctx, "foo", 1, 2, 3, 4, 1)
+	require.Nil(t, err)
+	require.Equal(t, []int{1, 3}, added)
+
+	require.Nil(t, b.Close())
+}
+
+func TestDiscardMany(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	// more values than can be bound to a single statement
+	values := make([]int, 0, 2500)
+	for i := range 2500 {
+		values = append(values, i)
+	}
+	_, err = b.Add(ctx, "foo", values...)
+	require.Nil(t, err)
+
+	// discard the even values, along with some which are not present
+	discard := make([]int, 0, 1500)
+	for i := 0; i < 3000; i += 2 {
+		discard = append(discard, i)
+	}
+	n, err := b.Discard(ctx, "foo", discard...)
+	require.Nil(t, err)
+	require.Equal(t, int64(1250), n)
+
+	n, err = b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(1250), n)
+
+	require.Nil(t, b.Close())
+}
+
+func BenchmarkSmallAdds(b *testing.B) {
+	ctx := context.Background()
+	s, err := bigset.Create[int](logger)
+	require.Nil(b, err)
+	b.ResetTimer()
+	for i := range b.N {
+		if _, err := s.Add(ctx, "foo", i, i+1, i+2); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	require.Nil(b, s.Close())
+}
+
+// BenchmarkUnionManySources compares ways of adding many overlapping
+// sources to a set. Other than "Union" itself, which uses UNION ALL,
+// they are run directly against the database file.
+func BenchmarkUnionManySources(b *testing.B) {
+	const sources, size = 32, 2000
+	ctx := context.Background()
+	filename := filepath.Join(b.TempDir(), "union")
+	s, err := bigset.Create[int](logger, bigset.WithFilename[int](filename))
+	require.Nil(b, err)
+	names := make([]string, sources)
+	for i := range names {
+		names[i] = fmt.Sprintf("source %v", i)
+		values := make([]int, size)
+		for j := range values {
+			// each source overlaps half of the next one
+			values[j] = i*size/2 + j
+		}
+		_, err := s.AddSlice(ctx, names[i], values)
+		require.Nil(b, err)
+	}
+	db, err := sql.Open("sqlite3", filename+"?_busy_timeout=5000")
+	require.Nil(b, err)
+	defer db.Close()
+
+	selects := func(target string, join string) string {
+		parts := make([]string, len(names))
+		for i, name := range names {
+			parts[i] = fmt.Sprintf("SELECT k, v FROM \"%v\"", name)
+		}
+		return fmt.Sprintf("INSERT OR IGNORE INTO \"%v\"(k, v) ", target) + strings.Join(parts, join)
+	}
+	strategies := map[string]func(target string) error{
+		"Union": func(target string) error {
+			_, err := s.Union(ctx, target, names...)
+			return err
+		},
+		"UNION": func(target string) error {
+			_, err := db.ExecContext(ctx, selects(target, " UNION "))
+			return err
+		},
+		"one statement per source": func(target string) error {
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = tx.Rollback() }()
+			for _, name := range names {
+				sql := fmt.Sprintf(
+					"INSERT OR IGNORE INTO \"%v\"(k, v) SELECT k, v FROM \"%v\"",
+					target,
+					name,
+				)
+				if _, err := tx.ExecContext(ctx, sql); err != nil {
+					return err
+				}
+			}
+			return tx.Commit()
+		},
+	}
+	for name, strategy := range strategies {
+		b.Run(name, func(b *testing.B) {
+			for i := range b.N {
+				b.StopTimer()
+				target := fmt.Sprintf("target %v", i)
+				require.Nil(b, s.CreateSet(ctx, target))
+				b.StartTimer()
+				require.Nil(b, strategy(target))
+				b.StopTimer()
+				n, err := s.Cardinality(ctx, target)
+				require.Nil(b, err)
+				require.Equal(b, int64((sources+1)*size/2), n)
+				require.Nil(b, s.DropSet(ctx, target))
+			}
+		})
+	}
+	require.Nil(b, s.Close())
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "readonly")
+	b, err := bigset.Create[int](logger, bigset.WithFilename[int](filename))
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+
+	r, err := bigset.Create[int](
+		logger,
+		bigset.WithFilename[int](filename),
+		bigset.WithReadOnly[int](),
+	)
+	require.Nil(t, err)
+
+	n, err := r.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+	nums, err := r.Get(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 2, 3}, *nums)
+
+	// modifications are refused, whether or not the set exists
+	_, err = r.Add(ctx, "foo", 4)
+	require.ErrorIs(t, err, bigset.ErrReadOnly)
+	_, err = r.Add(ctx, "bar", 4)
+	require.ErrorIs(t, err, bigset.ErrReadOnly)
+	_, err = r.Discard(ctx, "foo", 1)
+	require.ErrorIs(t, err, bigset.ErrReadOnly)
+	_, err = r.Union(ctx, "foo", "foo")
+	require.ErrorIs(t, err, bigset.ErrReadOnly)
+
+	require.Nil(t, r.Close())
+	_, err = os.Stat(filename)
+	require.Nil(t, err)
+
+	// there must be a file to open
+	_, err = bigset.Create[int](logger, bigset.WithReadOnly[int]())
+	require.Error(t, err)
+}
+
+func TestWithoutRowid(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "withoutrowid")
+	b, err := bigset.Create[Book](
+		logger,
+		bigset.WithFilename[Book](filename),
+		bigset.WithKeyFunction(func(book *Book) []byte { return []byte(book.Name) }),
+		bigset.WithWithoutRowid[Book](),
+	)
+	require.Nil(t, err)
+	books := []Book{{Name: "a", Pages: 1}, {Name: "b", Pages: 2}, {Name: "c", Pages: 3}}
+	n, err := b.Add(ctx, "foo", books...)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+	n, err = b.Add(ctx, "foo", Book{Name: "a", Pages: 100})
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+
+	book, err := b.RetrieveIfExists(ctx, "foo", Book{Name: "b"})
+	require.Nil(t, err)
+	require.Equal(t, 2, book.Pages)
+
+	_, err = b.Add(ctx, "bar", books[0])
+	require.Nil(t, err)
+	intersection, err := b.Intersection(ctx, "baz", "foo", "bar")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), intersection)
+
+	popped, err := b.PopN(ctx, "foo", 2)
+	require.Nil(t, err)
+	require.Len(t, popped, 2)
+	n, err = b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+
+	other, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	var definition string
+	require.Nil(t, other.QueryRowContext(ctx, "SELECT sql FROM sqlite_master WHERE name = 'foo'").Scan(&definition))
+	require.Contains(t, definition, "WITHOUT ROWID")
+	require.Nil(t, other.Close())
+	require.Nil(t, b.Close())
+}
+
+func TestKeys(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](
+		logger,
+		bigset.WithKeyFunction(func(book *Book) []byte { return []byte(book.Name) }),
+	)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", Book{Name: "a"}, Book{Name: "b"}, Book{Name: "c"})
+	require.Nil(t, err)
+
+	keys, err := b.Keys(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, keys)
+
+	var count int
+	err = b.EachKey(ctx, "foo", func(ctx context.Context, key []byte) error {
+		count++
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 3, count)
+
+	require.Nil(t, b.Close())
+}
+
+func TestIsEmpty(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	empty, err := b.IsEmpty(ctx, "missing")
+	require.Nil(t, err)
+	require.True(t, empty)
+
+	_, err = b.Add(ctx, "foo", 1)
+	require.Nil(t, err)
+	empty, err = b.IsEmpty(ctx, "foo")
+	require.Nil(t, err)
+	require.False(t, empty)
+
+	_, err = b.Discard(ctx, "foo", 1)
+	require.Nil(t, err)
+	empty, err = b.IsEmpty(ctx, "foo")
+	require.Nil(t, err)
+	require.True(t, empty)
+
+	require.Nil(t, b.Close())
+}
+
+func TestCardinality(t *testing.T) {
+	ctx := context.Background()
+	plain, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+	expiring, err := bigset.Create[int](logger, bigset.WithTTL[int](time.Hour))
+	require.Nil(t, err)
+	// the count takes no parameters, with or without an expiry condition
+	for _, b := range []*bigset.Bigset[int]{plain, expiring} {
+
+		_, err := b.Add(ctx, "foo")
+		require.Nil(t, err)
+		n, err := b.Cardinality(ctx, "foo")
+		require.Nil(t, err)
+		require.Equal(t, int64(0), n)
+
+		_, err = b.Add(ctx, "foo", 1, 2, 3)
+		require.Nil(t, err)
+		n, err = b.Cardinality(ctx, "foo")
+		require.Nil(t, err)
+		require.Equal(t, int64(3), n)
+
+		require.Nil(t, b.Close())
+	}
+}
+
+func TestCardinalities(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "bar", 4)
+	require.Nil(t, err)
+
+	result, err := b.Cardinalities(ctx, "foo", "bar", "missing", "foo")
+	require.Nil(t, err)
+	require.Equal(t, map[string]int64{"foo": 3, "bar": 1, "missing": 0}, result)
+
+	_, err = b.Cardinalities(ctx, "foo", "bad\"name")
+	require.Error(t, err)
+
+	// more sets than can be combined into a single compound SELECT
+	names := make([]string, 600)
+	for i := range names {
+		names[i] = fmt.Sprintf("set%v", i)
+		_, err = b.Add(ctx, names[i], i)
+		require.Nil(t, err)
+	}
+	result, err = b.Cardinalities(ctx, names...)
+	require.Nil(t, err)
+	require.Len(t, result, 600)
+	for _, name := range names {
+		require.Equal(t, int64(1), result[name])
+	}
+
+	require.Nil(t, b.Close())
+}
+
+func TestCardinalityEstimate(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	n, err := b.CardinalityEstimate(ctx, "missing")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	n, err = b.CardinalityEstimate(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	// removed items may still be counted
+	_, err = b.Discard(ctx, "foo", 1)
+	require.Nil(t, err)
+	n, err = b.CardinalityEstimate(ctx, "foo")
+	require.Nil(t, err)
+	require.GreaterOrEqual(t, n, int64(2))
+
+	require.Nil(t, b.Close())
+}
+
+func TestAnalyze(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	require.Nil(t, b.Analyze(ctx, "missing"))
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3, 4)
+	require.Nil(t, err)
+	_, err = b.Discard(ctx, "foo", 4)
+	require.Nil(t, err)
+	require.Nil(t, b.Analyze(ctx, "foo"))
+	n, err := b.CardinalityEstimate(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	// the statistics are stale until analysed again
+	_, err = b.Add(ctx, "foo", 5, 6)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "bar", 1)
+	require.Nil(t, err)
+	n, err = b.CardinalityEstimate(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+	require.Nil(t, b.AnalyzeAll(ctx))
+	n, err = b.CardinalityEstimate(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(5), n)
+	n, err = b.CardinalityEstimate(ctx, "bar")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestStrictSets(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger, bigset.WithStrictSets[int]())
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1)
+	require.ErrorIs(t, err, bigset.ErrSetNotFound)
+	_, err = b.Cardinality(ctx, "foo")
+	require.ErrorIs(t, err, bigset.ErrSetNotFound)
+	_, err = b.IsEmpty(ctx, "foo")
+	require.ErrorIs(t, err, bigset.ErrSetNotFound)
+	for _, err := range b.All(ctx, "foo") {
+		require.ErrorIs(t, err, bigset.ErrSetNotFound)
+	}
+
+	require.Nil(t, b.CreateSet(ctx, "foo"))
+	require.Nil(t, b.CreateSet(ctx, "foo"))
+	_, err = b.Add(ctx, "foo", 1, 2)
+	require.Nil(t, err)
+	n, err := b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	// sources must exist too
+	require.Nil(t, b.CreateSet(ctx, "bar"))
+	_, err = b.Union(ctx, "bar", "foo", "fooo")
+	require.ErrorIs(t, err, bigset.ErrSetNotFound)
+
+	err = b.WithTx(ctx, func(tx *bigset.Tx[int]) error {
+		_, err := tx.Add(ctx, "baz", 1)
+		return err
+	})
+	require.ErrorIs(t, err, bigset.ErrSetNotFound)
+
+	require.Nil(t, b.Close())
+}
+
+func TestReplace(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	n, err := b.Replace(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	n, err = b.Replace(ctx, "foo", 3, 4, 4)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+	values, err := b.Get(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{3, 4}, *values)
+
+	n, err = b.Replace(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestSlices(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](
+		logger,
+		bigset.WithKeyFunction(func(book *Book) []byte { return []byte(book.Name) }),
+	)
+	require.Nil(t, err)
+
+	books := make([]Book, 0, 100)
+	for i := range 100 {
+		books = append(books, Book{Name: fmt.Sprint(i), Pages: i})
+	}
+	n, err := b.AddSlice(ctx, "foo", books)
+	require.Nil(t, err)
+	require.Equal(t, int64(100), n)
+
+	for i := range books {
+		books[i].Pages++
+	}
+	n, err = b.SupersedeSlice(ctx, "foo", books[:10])
+	require.Nil(t, err)
+	require.Equal(t, int64(10), n)
+	book, err := b.RetrieveIfExists(ctx, "foo", Book{Name: "0"})
+	require.Nil(t, err)
+	require.Equal(t, 1, book.Pages)
+
+	n, err = b.DiscardSlice(ctx, "foo", books[50:])
+	require.Nil(t, err)
+	require.Equal(t, int64(50), n)
+	n, err = b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(50), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestSlice(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 3, 1, 2)
+	require.Nil(t, err)
+	values, err := b.Slice(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 2, 3}, values)
+
+	require.Nil(t, b.Close())
+}
+
+func TestSliceConsistent(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo")
+	require.Nil(t, err)
+
+	// elements are added ten at a time, so a consistent read
+	// always sees a multiple of ten of them
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			values := make([]int, 0, 10)
+			for j := range 10 {
+				values = append(values, i*10+j)
+			}
+			_, err := b.Add(ctx, "foo", values...)
+			require.Nil(t, err)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		values, err := b.Slice(ctx, "foo")
+		require.Nil(t, err)
+		require.Zero(t, len(values)%10)
+	}
+	wg.Wait()
+
+	values, err := b.Slice(ctx, "foo")
+	require.Nil(t, err)
+	require.Len(t, values, 1000)
+	require.Nil(t, b.Close())
+}
+
+func TestSnapshotReads(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger, bigset.WithWAL[int](), bigset.WithSnapshotReads[int]())
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+
+	// elements added during the iteration are not visited
+	var buffer, visited int
+	err = b.Each(ctx, "foo", &buffer, func(ctx context.Context) error {
+		visited++
+		_, err := b.Add(ctx, "foo", buffer+100)
+		return err
+	})
+	require.Nil(t, err)
+	require.Equal(t, 3, visited)
+	n, err := b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(6), n)
+
+	// as are those added while ranging over All
+	visited = 0
+	for value, err := range b.All(ctx, "foo") {
+		require.Nil(t, err)
+		visited++
+		_, err = b.Add(ctx, "foo", value+1000)
+		require.Nil(t, err)
+	}
+	require.Equal(t, 6, visited)
+	n, err = b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(12), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestSkipDecodeErrors(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "bigset.db")
+
+	// store elements which cannot be read back as integers
+	s, err := bigset.Create[any](logger, bigset.WithFilename[any](filename))
+	require.Nil(t, err)
+	_, err = s.Add(ctx, "foo", 1, "two", 3)
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+
+	b, err := bigset.Create[int](logger, bigset.WithFilename[int](filename))
+	require.Nil(t, err)
+	_, err = b.Slice(ctx, "foo")
+	require.Error(t, err)
+	require.Nil(t, b.Close())
+
+	var skipped []string
+	b, err = bigset.Create[int](
+		logger,
+		bigset.WithFilename[int](filename),
+		bigset.WithSkipDecodeErrors[int](func(key, raw []byte, err error) {
+			require.Error(t, err)
+			skipped = append(skipped, string(raw))
+		}),
+	)
+	require.Nil(t, err)
+	values, err := b.Slice(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 3}, values)
+	require.Equal(t, []string{`"two"`}, skipped)
+
+	var buffer int
+	var visited int
+	err = b.Each(ctx, "foo", &buffer, func(ctx context.Context) error {
+		visited++
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, visited)
+	require.Len(t, skipped, 2)
+
+	require.Nil(t, b.Close())
+}
+
+func TestNilLogger(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](nil)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	nums, err := b.Get(ctx, "foo")
+	require.Nil(t, err)
+	require.Len(t, *nums, 3)
+	require.Nil(t, b.Close())
+
+	b, err = bigset.Create[int](nil, bigset.WithLogger[int](slog.Default()))
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+
+	b, err = bigset.Create[int](nil, bigset.WithLogger[int](bigset.ZapLogger(logger)))
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+}
+
+func TestAll(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1, 2, 3, 4, 5)
+	require.Nil(t, err)
+
+	var result []int
+	for v, err := range b.All(ctx, "foo") {
+		require.Nil(t, err)
+		result = append(result, v)
+	}
+	require.ElementsMatch(t, []int{1, 2, 3, 4, 5}, result)
+
+	// stopping early is fine
+	var count int
+	for _, err := range b.All(ctx, "foo") {
+		require.Nil(t, err)
+		count++
+		if count == 2 {
+			break
+		}
+	}
+	require.Equal(t, 2, count)
+
+	// errors are yielded
+	var errs []error
+	for _, err := range b.All(ctx, "fo\"o") {
+		errs = append(errs, err)
+	}
+	require.Len(t, errs, 1)
+	require.ErrorIs(t, errs[0], bigset.ErrInvalidName)
+
+	require.Nil(t, b.Close())
+}
+
+func TestAllKeys(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](
+		logger,
+		bigset.WithKeyFunction(func(book *Book) []byte { return []byte(book.Name) }),
+	)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", Book{Name: "a"}, Book{Name: "b"}, Book{Name: "c"})
+	require.Nil(t, err)
+
+	var keys [][]byte
+	for k, err := range b.AllKeys(ctx, "foo") {
+		require.Nil(t, err)
+		keys = append(keys, k)
+	}
+	require.ElementsMatch(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, keys)
+
+	for range b.AllKeys(ctx, "foo") {
+		break
+	}
+	// the rows were closed, so the set can still be modified
+	_, err = b.Add(ctx, "foo", Book{Name: "d"})
+	require.Nil(t, err)
+
+	require.Nil(t, b.Close())
+}
+
+func TestVacuum(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "vacuum")
+	b, err := bigset.Create[int](logger, bigset.WithFilename[int](filename), bigset.WithWAL[int]())
+	require.Nil(t, err)
+	nums := make([]int, 100000)
+	for i := range nums {
+		nums[i] = i
+	}
+	_, err = b.AddSlice(ctx, "foo", nums)
+	require.Nil(t, err)
+	_, err = b.DiscardSlice(ctx, "foo", nums)
+	require.Nil(t, err)
+
+	require.Nil(t, b.Vacuum(ctx))
+	stat, err := os.Stat(filename)
+	require.Nil(t, err)
+	require.Less(t, stat.Size(), int64(100000))
+	require.Nil(t, b.Close())
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "bigset.db")
+	b, err := bigset.Create[int](logger, bigset.WithFilename[int](filename))
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+
+	ok, problems, err := b.CheckIntegrity(ctx)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Empty(t, problems)
+	require.Nil(t, b.Close())
+
+	// make an index disagree with its table, by changing its definition
+	// without rebuilding it
+	other, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	other.SetMaxOpenConns(1)
+	_, err = other.Exec("CREATE INDEX x ON foo(k)")
+	require.Nil(t, err)
+	_, err = other.Exec("PRAGMA writable_schema = ON")
+	require.Nil(t, err)
+	_, err = other.Exec("UPDATE sqlite_master SET sql = 'CREATE INDEX x ON foo(v)' WHERE name = 'x'")
+	require.Nil(t, err)
+	require.Nil(t, other.Close())
+
+	b, err = bigset.Create[int](logger, bigset.WithFilename[int](filename))
+	require.Nil(t, err)
+	ok, problems, err = b.CheckIntegrity(ctx)
+	require.Nil(t, err)
+	require.False(t, ok)
+	require.NotEmpty(t, problems)
+	require.Nil(t, b.Close())
+}
+
+func TestCompositeKey(t *testing.T) {
+	ctx := context.Background()
+	type Pair struct {
+		First, Second string
+		Count         int
+	}
+	b, err := bigset.Create[Pair](
+		logger,
+		bigset.WithCompositeKey(
+			func(p *Pair) []byte { return []byte(p.First) },
+			func(p *Pair) []byte { return []byte(p.Second) },
+		),
+	)
+	require.Nil(t, err)
+
+	// these would collide if the parts were concatenated
+	n, err := b.Add(ctx, "foo", Pair{First: "a", Second: "bc"}, Pair{First: "ab", Second: "c"})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	n, err = b.Add(ctx, "foo", Pair{First: "a", Second: "bc", Count: 1})
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestHashedKey(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](
+		logger,
+		bigset.WithHashedKey(func(book *Book) []byte { return []byte(book.Name) }, sha256.New),
+	)
+	require.Nil(t, err)
+	name := strings.Repeat("a very long name ", 100)
+	_, err = b.Add(ctx, "foo", Book{Name: name, Pages: 1}, Book{Name: "short", Pages: 2})
+	require.Nil(t, err)
+	n, err := b.Add(ctx, "foo", Book{Name: name, Pages: 3})
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+
+	book, err := b.RetrieveIfExists(ctx, "foo", Book{Name: name})
+	require.Nil(t, err)
+	require.Equal(t, 1, book.Pages)
+
+	keys, err := b.Keys(ctx, "foo")
+	require.Nil(t, err)
+	for _, k := range keys {
+		require.Len(t, k, sha256.Size)
+	}
+	require.Nil(t, b.Close())
+}
+
+func TestIntersectionFrom(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](
+		logger,
+		bigset.WithKeyFunction(func(book *Book) []byte { return []byte(book.Name) }),
+	)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "first", Book{Name: "a", Pages: 1}, Book{Name: "b", Pages: 1})
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "second", Book{Name: "a", Pages: 2}, Book{Name: "c", Pages: 2})
+	require.Nil(t, err)
+
+	n, err := b.IntersectionFrom(ctx, "result", "second", "first", "second")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+	books, err := b.Get(ctx, "result")
+	require.Nil(t, err)
+	require.Equal(t, []Book{{Name: "a", Pages: 2}}, *books)
+
+	_, err = b.IntersectionFrom(ctx, "result", "third", "first", "second")
+	require.Error(t, err)
+
+	require.Nil(t, b.Close())
+}
+
+func TestStream(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+
+	values, errs := b.Stream(ctx, "foo")
+	var result []int
+	for v := range values {
+		result = append(result, v)
+	}
+	require.Nil(t, <-errs)
+	require.ElementsMatch(t, []int{1, 2, 3}, result)
+
+	// abandoning the stream stops the goroutine
+	cancellable, cancel := context.WithCancel(ctx)
+	values, errs = b.Stream(cancellable, "foo")
+	<-values
+	cancel()
+	for range values {
+	}
+	require.ErrorIs(t, <-errs, context.Canceled)
+
+	_, errs = b.Stream(ctx, "fo\"o")
+	require.ErrorIs(t, <-errs, bigset.ErrInvalidName)
+
+	require.Nil(t, b.Close())
+}
+
+func TestDiskSize(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[string](logger)
+	require.Nil(t, err)
+
+	size, err := b.DiskSize(ctx, "missing")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), size)
+
+	_, err = b.Add(ctx, "small", "a")
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "large", strings.Repeat("a", 10000))
+	require.Nil(t, err)
+	small, err := b.DiskSize(ctx, "small")
+	require.Nil(t, err)
+	large, err := b.DiskSize(ctx, "large")
+	require.Nil(t, err)
+	require.Greater(t, small, int64(0))
+	require.Greater(t, large, int64(10000))
+
+	require.Nil(t, b.Close())
+}
+
+func TestIdentityKeyStoredOnce(t *testing.T) {
+	ctx := context.Background()
+	value := strings.Repeat("a", 10000)
+	identity, err := bigset.Create[string](logger)
+	require.Nil(t, err)
+	keyed, err := bigset.Create[string](
+		logger,
+		bigset.WithKeyFunction(func(s *string) []byte { return []byte(*s) }),
+	)
+	require.Nil(t, err)
+
+	for _, b := range []*bigset.Bigset[string]{identity, keyed} {
+		_, err = b.Add(ctx, "foo", value, "b")
+		require.Nil(t, err)
+		_, err = b.Union(ctx, "bar", "foo")
+		require.Nil(t, err)
+		stored, err := b.RetrieveIfExists(ctx, "bar", value)
+		require.Nil(t, err)
+		require.Equal(t, value, *stored)
+		values, err := b.Get(ctx, "bar")
+		require.Nil(t, err)
+		require.ElementsMatch(t, []string{value, "b"}, *values)
+		popped, err := b.PopN(ctx, "bar", 2)
+		require.Nil(t, err)
+		require.ElementsMatch(t, []string{value, "b"}, popped)
+	}
+
+	// the value is not stored separately from the key
+	identitySize, err := identity.DiskSize(ctx, "foo")
+	require.Nil(t, err)
+	keyedSize, err := keyed.DiskSize(ctx, "foo")
+	require.Nil(t, err)
+	require.Less(t, identitySize, keyedSize*3/4)
+
+	require.Nil(t, identity.Close())
+	require.Nil(t, keyed.Close())
+}
+
+func TestTempDir(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	b, err := bigset.Create[int](logger, bigset.WithTempDir[int](dir))
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1)
+	require.Nil(t, err)
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.NotEmpty(t, entries)
+
+	require.Nil(t, b.Close())
+	entries, err = os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+
+	_, err = bigset.Create[int](logger, bigset.WithTempDir[int](filepath.Join(dir, "missing")))
+	require.Error(t, err)
+}
+
+func TestInMemory(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger, bigset.WithInMemory[int]())
+	require.Nil(t, err)
+	other, err := bigset.Create[int](logger, bigset.WithInMemory[int]())
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	_, err = b.Union(ctx, "bar", "foo")
+	require.Nil(t, err)
+	n, err := b.Cardinality(ctx, "bar")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	// each in-memory database is independent
+	empty, err := other.IsEmpty(ctx, "foo")
+	require.Nil(t, err)
+	require.True(t, empty)
+
+	require.Nil(t, other.Close())
+	require.Nil(t, b.Close())
+
+	_, err = bigset.Create[int](
+		logger,
+		bigset.WithInMemory[int](),
+		bigset.WithFilename[int](filepath.Join(t.TempDir(), "memory")),
+	)
+	require.Error(t, err)
+}
+
+func TestInsertionOrder(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](
+		logger,
+		bigset.WithKeyFunction(func(book *Book) []byte { return []byte(book.Name) }),
+		bigset.WithInsertionOrder[Book](),
+	)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", Book{Name: "c"}, Book{Name: "a"}, Book{Name: "b"})
+	require.Nil(t, err)
+	// replacing an element keeps its position
+	_, err = b.Supersede(ctx, "foo", Book{Name: "c", Pages: 1}, Book{Name: "d"})
+	require.Nil(t, err)
+
+	var names []string
+	var buffer Book
+	err = b.EachInOrder(ctx, "foo", &buffer, func(ctx context.Context) error {
+		names = append(names, buffer.Name)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"c", "a", "b", "d"}, names)
+	sets, err := b.ListSets(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []string{"foo"}, sets)
+	require.Nil(t, b.Close())
+
+	_, err = bigset.Create[int](
+		logger,
+		bigset.WithInsertionOrder[int](),
+		bigset.WithWithoutRowid[int](),
+	)
+	require.Error(t, err)
+}
+
+func TestRetrieveMany(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](
+		logger,
+		bigset.WithKeyFunction(func(book *Book) []byte { return []byte(book.Name) }),
+	)
+	require.Nil(t, err)
+
+	books := make([]Book, 0, 2000)
+	for i := range 2000 {
+		books = append(books, Book{Name: fmt.Sprint(i), Pages: i})
+	}
+	_, err = b.AddSlice(ctx, "foo", books[:1500])
+	require.Nil(t, err)
+
+	// look them up in reverse, only by name
+	wanted := make([]Book, 0, len(books))
+	for i := len(books) - 1; i >= 0; i-- {
+		wanted = append(wanted, Book{Name: books[i].Name})
+	}
+	found, err := b.RetrieveMany(ctx, "foo", wanted...)
+	require.Nil(t, err)
+	require.Len(t, found, 2000)
+	for i, book := range found {
+		pages := 1999 - i
+		if pages >= 1500 {
+			require.Nil(t, book)
+		} else {
+			require.Equal(t, pages, book.Pages)
+		}
+	}
+
+	found, err = b.RetrieveMany(ctx, "missing", Book{Name: "1"})
+	require.Nil(t, err)
+	require.Equal(t, []*Book{nil}, found)
+
+	require.Nil(t, b.Close())
+}
@@ -0,0 +1,165 @@
+package bigset
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// bloomFilter records which keys may be present in a set. It can report
+// that a key which is absent may be present, but never the reverse.
+type bloomFilter struct {
+	mu     sync.RWMutex
+	bits   []uint64
+	hashes int
+	// false until every key already in the set has been added
+	ready bool
+}
+
+func newBloomFilter(expected int, falsePositiveRate float64) *bloomFilter {
+	size := math.Ceil(-float64(expected) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := max(1, int(math.Round(size/float64(expected)*math.Ln2)))
+	return &bloomFilter{bits: make([]uint64, int(size)/64+1), hashes: hashes}
+}
+
+// positions calls f with the bit positions corresponding to `key`,
+// derived from two halves of a single hash.
+func (f *bloomFilter) positions(key []byte, fn func(word int, mask uint64)) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32|1
+	n := uint64(len(f.bits) * 64)
+	for i := range uint64(f.hashes) {
+		position := (h1 + i*h2) % n
+		fn(int(position/64), 1<<(position%64))
+	}
+}
+
+func (f *bloomFilter) add(key []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.positions(key, func(word int, mask uint64) {
+		f.bits[word] |= mask
+	})
+}
+
+// mayContain returns false only if `key` has never been added.
+func (f *bloomFilter) mayContain(key []byte) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if !f.ready {
+		return true
+	}
+	result := true
+	f.positions(key, func(word int, mask uint64) {
+		result = result && f.bits[word]&mask != 0
+	})
+	return result
+}
+
+// WithBloomFilter keeps a bloom filter of the keys in each set in memory,
+// sized for `expected` keys with the given false positive rate, such as
+// 0.01. This allows Contains and RetrieveIfExists to return immediately
+// for most keys which are not present, without querying sqlite. Keys
+// which are present are looked up as usual, so this only speeds up misses.
+// A set's filter is built by scanning its keys the first time it is
+// needed while no writes are in progress, such as after reopening a file,
+// and again after a set operation such as Union adds elements to it. Filters are only aware of changes
+// made through this Bigset, so must not be used if another process
+// modifies the same file.
+func WithBloomFilter[T any](expected int, falsePositiveRate float64) option[T] {
+	return func(b *Bigset[T]) error {
+		if expected < 1 {
+			return errors.New("the expected number of keys must be positive.")
+		}
+		if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+			return errors.New("the false positive rate must be between 0 and 1.")
+		}
+		b.bloomExpected, b.bloomRate = expected, falsePositiveRate
+		b.filters = make(map[string]*bloomFilter)
+		return nil
+	}
+}
+
+// filter returns the bloom filter for the named set, creating it if
+// required, or nil if bloom filters are not in use. The returned filter
+// may not be ready yet.
+func (b *Bigset[T]) filter(name string) (f *bloomFilter, created bool) {
+	if b.filters == nil {
+		return nil, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if f, exists := b.filters[name]; exists {
+		return f, false
+	}
+	f = newBloomFilter(b.bloomExpected, b.bloomRate)
+	b.filters[name] = f
+	return f, true
+}
+
+// filterAdd records that `key` may now be present in the named set.
+// A filter is not created if there is none, as it would then never be
+// populated with the keys already present; it will include `key` once
+// it is built.
+func (b *Bigset[T]) filterAdd(name string, key []byte) {
+	if b.filters == nil {
+		return
+	}
+	b.mu.RLock()
+	f := b.filters[name]
+	b.mu.RUnlock()
+	if f != nil {
+		f.add(key)
+	}
+}
+
+// forgetFilter discards the bloom filter of the named set, so it will
+// be rebuilt when next needed. This must be done whenever elements are
+// added to a set other than by filterAdd.
+func (b *Bigset[T]) forgetFilter(name string) {
+	if b.filters == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.filters, name)
+}
+
+// mayContain returns false if `key` is definitely not present in the
+// named set. It always returns true if bloom filters are not in use.
+func (b *Bigset[T]) mayContain(ctx context.Context, name string, key []byte) (bool, error) {
+	f, created := b.filter(name)
+	if f == nil {
+		return true, nil
+	}
+	if created {
+		// keys written but not yet committed would not be found by the
+		// scan, and may have been written before the filter existed, so
+		// it cannot be built until they are
+		if b.writes.Load() > 0 {
+			b.forgetFilter(name)
+			return true, nil
+		}
+		// keys added while this is running are also added to the filter,
+		// as it is already in place
+		exists, err := b.exists(ctx, name)
+		if err == nil && exists {
+			err = b.EachKey(ctx, name, func(ctx context.Context, key []byte) error {
+				f.add(key)
+				return nil
+			})
+		}
+		if err != nil {
+			b.forgetFilter(name)
+			return true, err
+		}
+		f.mu.Lock()
+		f.ready = true
+		f.mu.Unlock()
+	}
+	return f.mayContain(key), nil
+}
@@ -0,0 +1,148 @@
+package bigset_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "bloom")
+	b, err := bigset.Create[int](
+		logger,
+		bigset.WithFilename[int](filename),
+		bigset.WithBloomFilter[int](1000, 0.01),
+	)
+	require.Nil(t, err)
+
+	nums := make([]int, 500)
+	for i := range nums {
+		nums[i] = i * 2
+	}
+	_, err = b.AddSlice(ctx, "even", nums)
+	require.Nil(t, err)
+	for i := range 1000 {
+		found, err := b.Contains(ctx, "even", i)
+		require.Nil(t, err)
+		require.Equal(t, i%2 == 0, found, i)
+	}
+
+	// elements added after the filter was built are found
+	_, err = b.Add(ctx, "even", 1000)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "odd", 1001)
+	require.Nil(t, err)
+	_, err = b.Union(ctx, "even", "odd")
+	require.Nil(t, err)
+	err = b.WithTx(ctx, func(tx *bigset.Tx[int]) error {
+		_, err := tx.Add(ctx, "even", 1003)
+		return err
+	})
+	require.Nil(t, err)
+	for _, i := range []int{1000, 1001, 1003} {
+		value, err := b.RetrieveIfExists(ctx, "even", i)
+		require.Nil(t, err)
+		require.Equal(t, i, *value)
+	}
+	require.Nil(t, b.Close())
+
+	// the filter is rebuilt when reopened
+	b, err = bigset.Create[int](
+		logger,
+		bigset.WithFilename[int](filename),
+		bigset.WithBloomFilter[int](1000, 0.01),
+	)
+	require.Nil(t, err)
+	found, err := b.Contains(ctx, "even", 998)
+	require.Nil(t, err)
+	require.True(t, found)
+	found, err = b.Contains(ctx, "even", 999)
+	require.Nil(t, err)
+	require.False(t, found)
+	found, err = b.Contains(ctx, "missing", 1)
+	require.Nil(t, err)
+	require.False(t, found)
+	require.Nil(t, b.Close())
+
+	_, err = bigset.Create[int](logger, bigset.WithBloomFilter[int](1000, 1.5))
+	require.Error(t, err)
+}
+
+func TestBloomFilterBuiltAfterAdd(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "bloom")
+	b, err := bigset.Create[int](
+		logger,
+		bigset.WithFilename[int](filename),
+		bigset.WithBloomFilter[int](1000, 0.01),
+	)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1)
+	require.Nil(t, err)
+	found, err := b.Contains(ctx, "foo", 1)
+	require.Nil(t, err)
+	require.True(t, found)
+
+	// once the filter has been built, a key it has not seen is reported
+	// as missing without querying the database, so one added by another
+	// instance is not found
+	other, err := bigset.Create[int](logger, bigset.WithFilename[int](filename))
+	require.Nil(t, err)
+	_, err = other.Add(ctx, "foo", 2)
+	require.Nil(t, err)
+	require.Nil(t, other.Close())
+	found, err = b.Contains(ctx, "foo", 2)
+	require.Nil(t, err)
+	require.False(t, found)
+
+	require.Nil(t, b.Close())
+}
+
+func TestBloomFilterDuringTx(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger, bigset.WithBloomFilter[int](1000, 0.01))
+	require.Nil(t, err)
+
+	// a filter cannot be built while keys are waiting to be committed
+	err = b.WithTx(ctx, func(tx *bigset.Tx[int]) error {
+		if _, err := tx.Add(ctx, "s", 1); err != nil {
+			return err
+		}
+		found, err := b.Contains(ctx, "s", 2)
+		require.False(t, found)
+		return err
+	})
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "s", 2)
+	require.Nil(t, err)
+	n, err := b.Cardinality(ctx, "s")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+	found, err := b.Contains(ctx, "s", 1)
+	require.Nil(t, err)
+	require.True(t, found)
+	value, err := b.RetrieveIfExists(ctx, "s", 1)
+	require.Nil(t, err)
+	require.Equal(t, 1, *value)
+
+	// nor can one be rebuilt before a union within a transaction commits
+	_, err = b.Add(ctx, "t", 3)
+	require.Nil(t, err)
+	err = b.WithTx(ctx, func(tx *bigset.Tx[int]) error {
+		if _, err := tx.Union(ctx, "s", "t"); err != nil {
+			return err
+		}
+		_, err := b.Contains(ctx, "s", 4)
+		return err
+	})
+	require.Nil(t, err)
+	found, err = b.Contains(ctx, "s", 3)
+	require.Nil(t, err)
+	require.True(t, found)
+
+	require.Nil(t, b.Close())
+}
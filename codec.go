@@ -0,0 +1,169 @@
+package bigset
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Codec converts elements to and from the bytes stored in the database,
+// in place of JSON. When no key function is given, the encoded element
+// is also its key, so equal elements must always encode identically.
+type Codec[T any] struct {
+	Marshal   func(*T) ([]byte, error)
+	Unmarshal func([]byte, *T) error
+}
+
+// WithCodec stores elements using `codec` rather than as JSON, such as
+// one of the binary codecs given by WithBinaryCodec, which are smaller
+// and cheaper to encode. A set must always be read with the codec it was
+// written with. Export, Import, DumpAll and LoadAll still use JSON.
+func WithCodec[T any](codec Codec[T]) option[T] {
+	return func(b *Bigset[T]) error {
+		if codec.Marshal == nil || codec.Unmarshal == nil {
+			return errors.New("a codec must provide both Marshal and Unmarshal.")
+		}
+		b.codec = &codec
+		if !b.customKey {
+			b.mapper = func(t *T) ([]byte, []byte, error) {
+				v, err := b.marshal(t)
+				if err != nil {
+					return nil, nil, err
+				}
+				return v, v, nil
+			}
+		}
+		return nil
+	}
+}
+
+// WithBinaryCodec is like WithCodec, choosing the binary codec for T,
+// which must be one of int, uint, int64, uint64 or string.
+func WithBinaryCodec[T any]() option[T] {
+	var codec any
+	switch any(*new(T)).(type) {
+	case int:
+		codec = IntCodec()
+	case uint:
+		codec = UintCodec()
+	case int64:
+		codec = Int64Codec()
+	case uint64:
+		codec = Uint64Codec()
+	case string:
+		codec = StringCodec()
+	default:
+		return func(b *Bigset[T]) error {
+			return fmt.Errorf("there is no binary codec for %T.", *new(T))
+		}
+	}
+	return WithCodec(codec.(Codec[T]))
+}
+
+// marshal encodes an element for storage.
+func (b *Bigset[T]) marshal(t *T) ([]byte, error) {
+	if b.codec != nil {
+		return b.codec.Marshal(t)
+	}
+	return json.Marshal(t)
+}
+
+// unmarshal decodes a stored element.
+func (b *Bigset[T]) unmarshal(raw []byte, t *T) error {
+	if b.codec != nil {
+		return b.codec.Unmarshal(raw, t)
+	}
+	return json.Unmarshal(raw, t)
+}
+
+// Int64Codec stores each integer as 8 big-endian bytes, with the sign bit
+// inverted so that keys sort in numerical order, as with EachOrdered.
+func Int64Codec() Codec[int64] {
+	return Codec[int64]{
+		Marshal: func(i *int64) ([]byte, error) {
+			return binary.BigEndian.AppendUint64(nil, uint64(*i)^(1<<63)), nil
+		},
+		Unmarshal: func(raw []byte, i *int64) error {
+			u, err := decodeUint64(raw)
+			*i = int64(u ^ (1 << 63))
+			return err
+		},
+	}
+}
+
+// Uint64Codec stores each integer as 8 big-endian bytes, so that keys
+// sort in numerical order.
+func Uint64Codec() Codec[uint64] {
+	return Codec[uint64]{
+		Marshal: func(u *uint64) ([]byte, error) {
+			return binary.BigEndian.AppendUint64(nil, *u), nil
+		},
+		Unmarshal: func(raw []byte, u *uint64) (err error) {
+			*u, err = decodeUint64(raw)
+			return err
+		},
+	}
+}
+
+// IntCodec is like Int64Codec, for int.
+func IntCodec() Codec[int] {
+	c := Int64Codec()
+	return Codec[int]{
+		Marshal: func(i *int) ([]byte, error) {
+			i64 := int64(*i)
+			return c.Marshal(&i64)
+		},
+		Unmarshal: func(raw []byte, i *int) error {
+			var i64 int64
+			err := c.Unmarshal(raw, &i64)
+			if err == nil && (i64 < math.MinInt || i64 > math.MaxInt) {
+				err = fmt.Errorf("%v does not fit in an int.", i64)
+			}
+			*i = int(i64)
+			return err
+		},
+	}
+}
+
+// UintCodec is like Uint64Codec, for uint.
+func UintCodec() Codec[uint] {
+	c := Uint64Codec()
+	return Codec[uint]{
+		Marshal: func(u *uint) ([]byte, error) {
+			u64 := uint64(*u)
+			return c.Marshal(&u64)
+		},
+		Unmarshal: func(raw []byte, u *uint) error {
+			var u64 uint64
+			err := c.Unmarshal(raw, &u64)
+			if err == nil && u64 > math.MaxUint {
+				err = fmt.Errorf("%v does not fit in a uint.", u64)
+			}
+			*u = uint(u64)
+			return err
+		},
+	}
+}
+
+// StringCodec stores each string as its bytes, without quoting or escaping.
+func StringCodec() Codec[string] {
+	return Codec[string]{
+		Marshal: func(s *string) ([]byte, error) {
+			return []byte(*s), nil
+		},
+		Unmarshal: func(raw []byte, s *string) error {
+			*s = string(raw)
+			return nil
+		},
+	}
+}
+
+// decodeUint64 decodes 8 big-endian bytes.
+func decodeUint64(raw []byte) (uint64, error) {
+	if len(raw) != 8 {
+		return 0, fmt.Errorf("expected 8 bytes rather than %v.", len(raw))
+	}
+	return binary.BigEndian.Uint64(raw), nil
+}
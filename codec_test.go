@@ -0,0 +1,124 @@
+package bigset_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinaryCodec(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int64](logger, bigset.WithBinaryCodec[int64]())
+	require.Nil(t, err)
+
+	n, err := b.Add(ctx, "foo", 3, -2, 1<<40, 3, -1<<40)
+	require.Nil(t, err)
+	require.Equal(t, int64(4), n)
+	found, err := b.RetrieveIfExists(ctx, "foo", -2)
+	require.Nil(t, err)
+	require.Equal(t, int64(-2), *found)
+
+	// keys sort in numerical order, including negative numbers
+	var buffer int64
+	var visited []int64
+	err = b.EachOrdered(ctx, "foo", &buffer, func(ctx context.Context) error {
+		visited = append(visited, buffer)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []int64{-1 << 40, -2, 3, 1 << 40}, visited)
+
+	k, err := b.KeyOf(1)
+	require.Nil(t, err)
+	require.Len(t, k, 8)
+
+	// exports are still JSON
+	var out bytes.Buffer
+	_, err = b.Export(ctx, "foo", &out)
+	require.Nil(t, err)
+	require.ElementsMatch(
+		t,
+		[]string{"-1099511627776", "-2", "3", "1099511627776"},
+		strings.Fields(out.String()),
+	)
+
+	require.Nil(t, b.Close())
+}
+
+func TestStringCodec(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[string](logger, bigset.WithCodec(bigset.StringCodec()))
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", "", "a \"quoted\" string", "ü")
+	require.Nil(t, err)
+	values, err := b.Slice(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"", "a \"quoted\" string", "ü"}, values)
+
+	require.Nil(t, b.Close())
+
+	_, err = bigset.Create[float64](logger, bigset.WithBinaryCodec[float64]())
+	require.Error(t, err)
+}
+
+func TestCodecWithKeyFunction(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[uint](
+		logger,
+		bigset.WithKeyFunction(func(u *uint) []byte { return []byte{byte(*u % 10)} }),
+		bigset.WithCodec(bigset.UintCodec()),
+	)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 11)
+	require.Nil(t, err)
+	_, err = b.Supersede(ctx, "foo", 12)
+	require.Nil(t, err)
+	values, err := b.Slice(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []uint{1, 12}, values)
+
+	require.Nil(t, b.Close())
+}
+
+func BenchmarkCodec(b *testing.B) {
+	const size = 1_000_000
+	ctx := context.Background()
+	values := make([]uint64, size)
+	for i := range values {
+		values[i] = uint64(i) * 7919
+	}
+	for _, binary := range []bool{false, true} {
+		name := "JSON"
+		if binary {
+			name = "binary"
+		}
+		b.Run(name, func(b *testing.B) {
+			var diskSize int64
+			for range b.N {
+				var s *bigset.Bigset[uint64]
+				var err error
+				if binary {
+					s, err = bigset.Create[uint64](logger, bigset.WithBinaryCodec[uint64]())
+				} else {
+					s, err = bigset.Create[uint64](logger)
+				}
+				require.Nil(b, err)
+				_, err = s.AddSlice(ctx, "foo", values)
+				require.Nil(b, err)
+				var buffer uint64
+				err = s.Each(ctx, "foo", &buffer, func(ctx context.Context) error { return nil })
+				require.Nil(b, err)
+				diskSize, err = s.DiskSize(ctx, "foo")
+				require.Nil(b, err)
+				require.Nil(b, s.Close())
+			}
+			b.ReportMetric(float64(diskSize)/size, "bytes/element")
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package bigset
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ColumnSpec describes an additional column which is stored alongside
+// each element, so that elements can be found by it using SelectByColumn.
+type ColumnSpec struct {
+	// Name must be a valid SQL identifier: letters, digits and
+	// underscores, not beginning with a digit.
+	Name string
+	// Type is the column's declared type, which determines how its values
+	// are compared. It must be one of INTEGER, REAL, TEXT, BLOB or NUMERIC,
+	// or empty.
+	Type string
+	// Indexed columns can be searched without scanning the entire set,
+	// at the cost of additional space and slower writes.
+	Indexed bool
+}
+
+// validColumnName matches the names which can be used for extra columns.
+var validColumnName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedColumns are used by bigset itself, so cannot be extra columns.
+var reservedColumns = []string{"k", "v", "seq", "inserted_at", "count", "rowid", "oid", "_rowid_"}
+
+// columnTypes are the declared types which extra columns may have.
+var columnTypes = []string{"", "INTEGER", "REAL", "TEXT", "BLOB", "NUMERIC"}
+
+// WithExtraColumns stores additional columns alongside each element,
+// whose values are given by `extract`, in the same order as `columns`.
+// These are populated whenever an element is added or replaced, and are
+// copied along with it by operations such as Union.
+// Sets created before this option was used do not have these columns,
+// so cannot be written to once it is.
+func WithExtraColumns[T any](columns []ColumnSpec, extract func(*T) []any) option[T] {
+	return func(b *Bigset[T]) error {
+		if extract == nil {
+			return errors.New("an extract function must be provided.")
+		}
+		seen := make(map[string]struct{}, len(columns))
+		for _, c := range columns {
+			if !validColumnName.MatchString(c.Name) {
+				return fmt.Errorf("%q is not a valid column name.", c.Name)
+			}
+			lower := strings.ToLower(c.Name)
+			if slices.Contains(reservedColumns, lower) {
+				return fmt.Errorf("%q is a reserved column name.", c.Name)
+			}
+			if _, exists := seen[lower]; exists {
+				return fmt.Errorf("the column %q is given more than once.", c.Name)
+			}
+			seen[lower] = struct{}{}
+			if !slices.Contains(columnTypes, strings.ToUpper(c.Type)) {
+				return fmt.Errorf("%q is not a supported column type.", c.Type)
+			}
+		}
+		b.extraColumns = columns
+		b.extract = extract
+		return nil
+	}
+}
+
+// row returns the key of an element, along with the arguments used to
+// store it: its key, value, and the value of each extra column.
+// If the key is the value, the value is stored as NULL, as it is always
+// read as COALESCE(v, k), halving the space used.
+func (b *Bigset[T]) row(value *T) ([]byte, []any, error) {
+	k, v, err := b.encode(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !b.customKey {
+		v = nil
+	}
+	args := []any{k, v}
+	if b.extract != nil {
+		extra := b.extract(value)
+		if len(extra) != len(b.extraColumns) {
+			return nil, nil, fmt.Errorf(
+				"the element with key %v has %v extra column values instead of %v.",
+				describeKey(k),
+				len(extra),
+				len(b.extraColumns),
+			)
+		}
+		args = append(args, extra...)
+	}
+	return k, args, nil
+}
+
+// columns returns the comma-separated list of columns copied when
+// elements are copied between sets, each qualified by `table` if
+// it is not empty.
+func (b *Bigset[T]) columns(table string) string {
+	var qualifier string
+	if table != "" {
+		qualifier = fmt.Sprintf("\"%v\".", b.table(table))
+	}
+	var result strings.Builder
+	fmt.Fprintf(&result, "k, %vv", qualifier)
+	for _, c := range b.extraColumns {
+		fmt.Fprintf(&result, ", %v\"%v\"", qualifier, c.Name)
+	}
+	return result.String()
+}
+
+// placeholders returns the parameters for the arguments returned by row.
+func (b *Bigset[T]) placeholders() string {
+	return placeholders(2 + len(b.extraColumns))
+}
+
+// extraAssignments returns the assignments which update the extra
+// columns. If `excluded` is true, their values are taken from the row
+// which could not be inserted; otherwise, each is taken from a parameter.
+func (b *Bigset[T]) extraAssignments(excluded bool) string {
+	var result strings.Builder
+	for _, c := range b.extraColumns {
+		if excluded {
+			fmt.Fprintf(&result, ", \"%v\" = excluded.\"%v\"", c.Name, c.Name)
+		} else {
+			fmt.Fprintf(&result, ", \"%v\" = ?", c.Name)
+		}
+	}
+	return result.String()
+}
+
+// indexSQL returns the statements used to create the indexes of the
+// named set's extra columns.
+func (b *Bigset[T]) indexSQL(name string) string {
+	var result strings.Builder
+	for _, c := range b.extraColumns {
+		if c.Indexed {
+			fmt.Fprintf(
+				&result,
+				"CREATE INDEX IF NOT EXISTS \"%v:%v\" ON \"%v\"(\"%v\");",
+				b.table(name),
+				c.Name,
+				b.table(name),
+				c.Name,
+			)
+		}
+	}
+	return result.String()
+}
+
+// moveIndexes replaces the indexes of a renamed set, as their names
+// include that of the set.
+func (b *Bigset[T]) moveIndexes(ctx context.Context, tx *sql.Tx, oldName, newName string) error {
+	for _, c := range b.extraColumns {
+		if c.Indexed {
+			sql := fmt.Sprintf("DROP INDEX IF EXISTS \"%v:%v\"", b.table(oldName), c.Name)
+			if _, err := tx.ExecContext(ctx, sql); err != nil {
+				return err
+			}
+		}
+	}
+	if sql := b.indexSQL(newName); sql != "" {
+		if _, err := tx.ExecContext(ctx, sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SelectByColumn returns every element of a set whose extra column
+// `column`, as given to WithExtraColumns, is equal to `value`.
+// This is only efficient if the column is indexed.
+func (b *Bigset[T]) SelectByColumn(ctx context.Context, name, column string, value any) ([]T, error) {
+	if err := verifyNames(name); err != nil {
+		return nil, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(b.extraColumns, func(c ColumnSpec) bool { return c.Name == column }) {
+		return nil, fmt.Errorf("%q is not an extra column.", column)
+	}
+	exists, err := b.exists(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return []T{}, nil
+	}
+	rows, err := b.db.Reader().QueryContext(
+		ctx,
+		fmt.Sprintf(
+			"SELECT k, COALESCE(v, k) FROM \"%v\" WHERE \"%v\" = ?%v",
+			b.table(name),
+			column,
+			b.expiry(" AND "),
+		),
+		value,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return b.collect(rows, 0)
+}
@@ -0,0 +1,83 @@
+package bigset_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtraColumns(t *testing.T) {
+	ctx := context.Background()
+	columns := []bigset.ColumnSpec{
+		{Name: "pages", Type: "INTEGER", Indexed: true},
+		{Name: "favourite", Type: "INTEGER"},
+	}
+	extract := func(book *Book) []any {
+		return []any{book.Pages, book.Favourite}
+	}
+	b, err := bigset.Create[Book](
+		logger,
+		bigset.WithKeyFunction(func(book *Book) []byte { return []byte(book.Name) }),
+		bigset.WithExtraColumns(columns, extract),
+	)
+	require.Nil(t, err)
+
+	martin := Book{Name: "Martin the Warrior", Pages: 375, Favourite: true}
+	mossflower := Book{Name: "Mossflower", Pages: 420}
+	redwall := Book{Name: "Redwall", Pages: 375}
+	_, err = b.Add(ctx, "books", martin, mossflower, redwall)
+	require.Nil(t, err)
+
+	found, err := b.SelectByColumn(ctx, "books", "pages", 375)
+	require.Nil(t, err)
+	require.ElementsMatch(t, []Book{martin, redwall}, found)
+	found, err = b.SelectByColumn(ctx, "books", "favourite", true)
+	require.Nil(t, err)
+	require.ElementsMatch(t, []Book{martin}, found)
+
+	// only the key decides whether an element is already present
+	n, err := b.Add(ctx, "books", Book{Name: "Redwall", Pages: 1})
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+	found, err = b.SelectByColumn(ctx, "books", "pages", 1)
+	require.Nil(t, err)
+	require.Empty(t, found)
+
+	// replacing an element updates its columns
+	mossflower.Pages = 375
+	_, err = b.Supersede(ctx, "books", mossflower)
+	require.Nil(t, err)
+	found, err = b.SelectByColumn(ctx, "books", "pages", 375)
+	require.Nil(t, err)
+	require.Len(t, found, 3)
+
+	// the columns are copied along with the elements
+	_, err = b.Union(ctx, "copy", "books")
+	require.Nil(t, err)
+	require.Nil(t, b.RenameSet(ctx, "copy", "renamed"))
+	found, err = b.SelectByColumn(ctx, "renamed", "favourite", true)
+	require.Nil(t, err)
+	require.ElementsMatch(t, []Book{martin}, found)
+
+	found, err = b.SelectByColumn(ctx, "missing", "pages", 375)
+	require.Nil(t, err)
+	require.Empty(t, found)
+	_, err = b.SelectByColumn(ctx, "books", "k", 375)
+	require.Error(t, err)
+
+	require.Nil(t, b.Close())
+
+	for _, spec := range []bigset.ColumnSpec{
+		{Name: "v"},
+		{Name: "bad name"},
+		{Name: "ok", Type: "VARCHAR(10)"},
+	} {
+		_, err := bigset.Create[Book](
+			logger,
+			bigset.WithExtraColumns([]bigset.ColumnSpec{spec}, extract),
+		)
+		require.Error(t, err, spec)
+	}
+}
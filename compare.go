@@ -0,0 +1,284 @@
+package bigset
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// exists returns true if the named set has a table in the database,
+// whether it was created during this session or is already present on disk.
+func (b *Bigset[T]) exists(ctx context.Context, name string) (bool, error) {
+	if b.known(name) {
+		return true, nil
+	}
+	return b.SetExists(ctx, name)
+}
+
+// SetExists returns true if the named set has a table in the database,
+// whether it was created during this session or is already present on disk.
+// Unlike the checks made by other methods, this always queries the
+// database, so it also notices a set which has since been dropped by
+// another process using the same file.
+func (b *Bigset[T]) SetExists(ctx context.Context, name string) (bool, error) {
+	if err := verifyNames(name); err != nil {
+		return false, err
+	}
+	result, err := tableExists(ctx, b.db.Reader(), b.table(name))
+	if err != nil {
+		return false, err
+	}
+	if result {
+		b.remember(name)
+	} else {
+		b.forget(name)
+		b.forgetFilter(name)
+	}
+	return result, nil
+}
+
+// liveKeys returns a query selecting the keys of the named set, excluding
+// those of expired elements.
+func (b *Bigset[T]) liveKeys(name string) string {
+	return fmt.Sprintf("SELECT k FROM \"%v\"%v", b.table(name), b.expiry(" WHERE "))
+}
+
+// IsSubset returns true if every element of `subset` is also present
+// in `superset`, as determined by their keys.
+// A set which does not exist is treated as empty, so an empty or missing
+// `subset` is a subset of anything.
+func (b *Bigset[T]) IsSubset(ctx context.Context, subset, superset string) (bool, error) {
+	if err := verifyNames(subset, superset); err != nil {
+		return false, err
+	}
+	if err := b.found(ctx, subset, superset); err != nil {
+		return false, err
+	}
+	subsetExists, err := b.exists(ctx, subset)
+	if err != nil {
+		return false, err
+	}
+	if !subsetExists {
+		return true, nil
+	}
+	supersetExists, err := b.exists(ctx, superset)
+	if err != nil {
+		return false, err
+	}
+	sql := fmt.Sprintf("SELECT NOT EXISTS (SELECT 1 FROM \"%v\"%v)", b.table(subset), b.expiry(" WHERE "))
+	if supersetExists {
+		sql = fmt.Sprintf(
+			"SELECT NOT EXISTS (SELECT 1 FROM \"%v\" WHERE k NOT IN (%v)%v)",
+			b.table(subset),
+			b.liveKeys(superset),
+			b.expiry(" AND "),
+		)
+	}
+	var result bool
+	if err := b.db.Reader().QueryRowContext(ctx, sql).Scan(&result); err != nil {
+		return false, err
+	}
+	return result, nil
+}
+
+// IsSuperset returns true if every element of `subset` is also present
+// in `superset`. It is the mirror of IsSubset.
+func (b *Bigset[T]) IsSuperset(ctx context.Context, superset, subset string) (bool, error) {
+	return b.IsSubset(ctx, subset, superset)
+}
+
+type equalsConfig struct {
+	compareValues bool
+}
+
+type equalsOption func(*equalsConfig)
+
+// WithValueComparison makes Equals compare the stored values as well as
+// the keys, so two sets are only equal if each key maps to the same
+// serialised value in both.
+func WithValueComparison() equalsOption {
+	return func(c *equalsConfig) {
+		c.compareValues = true
+	}
+}
+
+// Equals returns true if both sets contain exactly the same elements.
+// By default, only the keys (as produced by the key function) are compared;
+// use WithValueComparison to also require the values to match.
+// A set which does not exist is treated as empty.
+func (b *Bigset[T]) Equals(
+	ctx context.Context,
+	first, second string,
+	options ...equalsOption,
+) (bool, error) {
+	if err := verifyNames(first, second); err != nil {
+		return false, err
+	}
+	if err := b.found(ctx, first, second); err != nil {
+		return false, err
+	}
+	var config equalsConfig
+	for _, opt := range options {
+		opt(&config)
+	}
+	firstSize, err := b.size(ctx, first)
+	if err != nil {
+		return false, err
+	}
+	secondSize, err := b.size(ctx, second)
+	if err != nil {
+		return false, err
+	}
+	if firstSize != secondSize {
+		return false, nil
+	}
+	if firstSize == 0 {
+		return true, nil
+	}
+	// as keys are unique within a set, sets of equal size are equal
+	// if one is contained within the other
+	sql := fmt.Sprintf(
+		"SELECT NOT EXISTS (SELECT 1 FROM \"%v\" WHERE k NOT IN (%v)%v)",
+		b.table(first),
+		b.liveKeys(second),
+		b.expiry(" AND "),
+	)
+	if config.compareValues {
+		sql = fmt.Sprintf(
+			"SELECT NOT EXISTS (SELECT k, COALESCE(v, k) FROM \"%v\"%v EXCEPT SELECT k, COALESCE(v, k) FROM \"%v\"%v)",
+			b.table(first),
+			b.expiry(" WHERE "),
+			b.table(second),
+			b.expiry(" WHERE "),
+		)
+	}
+	var result bool
+	if err := b.db.Reader().QueryRowContext(ctx, sql).Scan(&result); err != nil {
+		return false, err
+	}
+	return result, nil
+}
+
+// size returns the number of items in a set, treating a missing set as empty.
+func (b *Bigset[T]) size(ctx context.Context, name string) (int64, error) {
+	exists, err := b.exists(ctx, name)
+	if err != nil {
+		return -1, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	return b.Cardinality(ctx, name)
+}
+
+// IsDisjoint returns true if the two sets have no keys in common.
+// A set which does not exist is treated as empty, and is therefore
+// disjoint from every other set.
+func (b *Bigset[T]) IsDisjoint(ctx context.Context, first, second string) (bool, error) {
+	if err := verifyNames(first, second); err != nil {
+		return false, err
+	}
+	if err := b.found(ctx, first, second); err != nil {
+		return false, err
+	}
+	for _, name := range []string{first, second} {
+		exists, err := b.exists(ctx, name)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return true, nil
+		}
+	}
+	sql := fmt.Sprintf(
+		"SELECT NOT EXISTS (SELECT 1 FROM \"%v\" WHERE k IN (%v)%v)",
+		b.table(first),
+		b.liveKeys(second),
+		b.expiry(" AND "),
+	)
+	var result bool
+	if err := b.db.Reader().QueryRowContext(ctx, sql).Scan(&result); err != nil {
+		return false, err
+	}
+	return result, nil
+}
+
+// DifferenceCardinality returns the number of elements of `source` which
+// are not present in any of the `subtract` sets, without creating a set
+// to hold them as Difference would.
+// A set which does not exist is treated as empty.
+func (b *Bigset[T]) DifferenceCardinality(
+	ctx context.Context,
+	source string,
+	subtract ...string,
+) (int64, error) {
+	query, err := b.differenceQuery(ctx, "COUNT(*)", source, subtract)
+	if err != nil {
+		return -1, err
+	}
+	if query == "" {
+		return 0, nil
+	}
+	var result int64
+	if err := b.db.Reader().QueryRowContext(ctx, query).Scan(&result); err != nil {
+		return -1, err
+	}
+	return result, nil
+}
+
+// EachDifference is like Each, but only visits the elements of `source`
+// which are not present in any of the `subtract` sets, without creating
+// a set to hold them as Difference would.
+// A set which does not exist is treated as empty.
+func (b *Bigset[T]) EachDifference(
+	ctx context.Context,
+	source string,
+	buffer *T,
+	f func(ctx context.Context) error,
+	subtract ...string,
+) error {
+	query, err := b.differenceQuery(ctx, "k, COALESCE(v, k)", source, subtract)
+	if err != nil || query == "" {
+		return err
+	}
+	return b.each(ctx, query, buffer, f)
+}
+
+// differenceQuery returns a query selecting `columns` from the elements of
+// `source` which are not present in any of the `subtract` sets, or nothing
+// if `source` does not exist.
+func (b *Bigset[T]) differenceQuery(
+	ctx context.Context,
+	columns string,
+	source string,
+	subtract []string,
+) (string, error) {
+	if err := verifyNames(source, subtract...); err != nil {
+		return "", err
+	}
+	if err := b.found(ctx, append([]string{source}, subtract...)...); err != nil {
+		return "", err
+	}
+	exists, err := b.exists(ctx, source)
+	if err != nil || !exists {
+		return "", err
+	}
+	conditions := make([]string, 0, len(subtract)+1)
+	if expiry := b.expiry(""); expiry != "" {
+		conditions = append(conditions, expiry)
+	}
+	for _, s := range subtract {
+		exists, err := b.exists(ctx, s)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			conditions = append(conditions, fmt.Sprintf("k NOT IN (%v)", b.liveKeys(s)))
+		}
+	}
+	query := fmt.Sprintf("SELECT %v FROM \"%v\"", columns, b.table(source))
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	return query, nil
+}
@@ -0,0 +1,237 @@
+package bigset_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubsetAndSuperset(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "small", 1, 2)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "large", 1, 2, 3)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "empty")
+	require.Nil(t, err)
+
+	ok, err := b.IsSubset(ctx, "small", "large")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	ok, err = b.IsSubset(ctx, "large", "small")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	ok, err = b.IsSuperset(ctx, "large", "small")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	// an empty set is a subset of anything
+	ok, err = b.IsSubset(ctx, "empty", "small")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	// missing sets are treated as empty
+	ok, err = b.IsSubset(ctx, "missing", "small")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	ok, err = b.IsSubset(ctx, "small", "missing")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	ok, err = b.IsSubset(ctx, "empty", "missing")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	_, err = b.IsSubset(ctx, "fo\"o", "small")
+	require.Error(t, err)
+
+	require.Nil(t, b.Close())
+}
+
+func TestEquals(t *testing.T) {
+	ctx := context.Background()
+	// books with the same name are considered the "same"
+	keyFunction := func(b *Book) []byte {
+		return []byte(b.Name)
+	}
+	b, err := bigset.Create[Book](logger, bigset.WithKeyFunction(keyFunction))
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "a", Book{Name: "x", Pages: 1}, Book{Name: "y", Pages: 2})
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "b", Book{Name: "y", Pages: 2}, Book{Name: "x", Pages: 10})
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "c", Book{Name: "x", Pages: 1})
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "empty")
+	require.Nil(t, err)
+
+	ok, err := b.Equals(ctx, "a", "b")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	// the page count of "x" differs
+	ok, err = b.Equals(ctx, "a", "b", bigset.WithValueComparison())
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	ok, err = b.Equals(ctx, "a", "a", bigset.WithValueComparison())
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	ok, err = b.Equals(ctx, "a", "c")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// missing sets are treated as empty
+	ok, err = b.Equals(ctx, "empty", "missing")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	ok, err = b.Equals(ctx, "a", "missing")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	require.Nil(t, b.Close())
+}
+
+func TestDisjoint(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "odd", 1, 3, 5)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "even", 2, 4, 6)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "prime", 2, 3, 5)
+	require.Nil(t, err)
+
+	ok, err := b.IsDisjoint(ctx, "odd", "even")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	ok, err = b.IsDisjoint(ctx, "odd", "prime")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// missing sets are treated as empty
+	ok, err = b.IsDisjoint(ctx, "odd", "missing")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	require.Nil(t, b.Close())
+}
+
+func TestDifferenceCardinality(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "all", 1, 2, 3, 4, 5, 6)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "even", 2, 4, 6)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "prime", 2, 3, 5)
+	require.Nil(t, err)
+
+	n, err := b.DifferenceCardinality(ctx, "all", "even", "prime")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+
+	n, err = b.DifferenceCardinality(ctx, "all")
+	require.Nil(t, err)
+	require.Equal(t, int64(6), n)
+
+	// missing sets are treated as empty
+	n, err = b.DifferenceCardinality(ctx, "all", "even", "missing")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+	n, err = b.DifferenceCardinality(ctx, "missing", "even")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+
+	// nothing is created
+	sets, err := b.ListSets(ctx)
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"all", "even", "prime"}, sets)
+
+	require.Nil(t, b.Close())
+}
+
+func TestEachDifference(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "all", 1, 2, 3, 4, 5, 6)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "even", 2, 4, 6)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "prime", 2, 3, 5)
+	require.Nil(t, err)
+
+	var buffer int
+	var visited []int
+	visit := func(ctx context.Context) error {
+		visited = append(visited, buffer)
+		return nil
+	}
+	require.Nil(t, b.EachDifference(ctx, "all", &buffer, visit, "even", "prime", "missing"))
+	require.Equal(t, []int{1}, visited)
+
+	visited = nil
+	require.Nil(t, b.EachDifference(ctx, "all", &buffer, visit, "even"))
+	require.ElementsMatch(t, []int{1, 3, 5}, visited)
+
+	visited = nil
+	require.Nil(t, b.EachDifference(ctx, "missing", &buffer, visit, "even"))
+	require.Empty(t, visited)
+
+	// nothing is created
+	sets, err := b.ListSets(ctx)
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"all", "even", "prime"}, sets)
+
+	require.Nil(t, b.Close())
+}
+
+func TestSetExists(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "db")
+	b, err := bigset.Create[int](logger, bigset.WithFilename[int](filename))
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1)
+	require.Nil(t, err)
+
+	// a set created by another instance using the same file is found
+	other, err := bigset.Create[int](logger, bigset.WithFilename[int](filename))
+	require.Nil(t, err)
+	exists, err := other.SetExists(ctx, "foo")
+	require.Nil(t, err)
+	require.True(t, exists)
+	exists, err = other.SetExists(ctx, "bar")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// as is one dropped since it was last checked
+	require.Nil(t, b.DropSet(ctx, "foo"))
+	exists, err = other.SetExists(ctx, "foo")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	_, err = other.SetExists(ctx, "bad\"name")
+	require.Error(t, err)
+
+	require.Nil(t, other.Close())
+	require.Nil(t, b.Close())
+}
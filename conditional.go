@@ -0,0 +1,415 @@
+package bigset
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// rowsQueryer is like queryer, for queries returning several rows.
+type rowsQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// lookup returns the element stored in the named set under `key`,
+// or nil if there is none.
+func (b *Bigset[T]) lookup(ctx context.Context, q queryer, name string, key []byte) (*T, error) {
+	var raw []byte
+	err := q.QueryRowContext(
+		ctx,
+		fmt.Sprintf("SELECT COALESCE(v, k) FROM \"%v\" WHERE k = ?%v", b.table(name), b.expiry(" AND ")),
+		key,
+	).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result T
+	if err := b.unmarshal(raw, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// transact runs `f` within a write transaction, committing it if `f`
+// succeeds and rolling it back otherwise.
+func (b *Bigset[T]) transact(ctx context.Context, f func(tx *sql.Tx) error) error {
+	if err := b.writable(); err != nil {
+		return err
+	}
+	tx, err := b.db.Writer().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	b.writes.Add(1)
+	defer b.writes.Add(-1)
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateIf stores `value` in a set, replacing any element with the same key,
+// but only if `shouldReplace` returns true. It is passed the element currently
+// stored under that key, or nil if there is none.
+// The read and the write happen within a single transaction, so no other
+// writer can modify the element in between.
+// Returns true if `value` was written.
+func (b *Bigset[T]) UpdateIf(
+	ctx context.Context,
+	name string,
+	value T,
+	shouldReplace func(existing *T) bool,
+) (bool, error) {
+	if err := verifyNames(name); err != nil {
+		return false, err
+	}
+	if !b.known(name) {
+		if err := b.initialise(ctx, name); err != nil {
+			return false, err
+		}
+	}
+	k, args, err := b.row(&value)
+	if err != nil {
+		return false, err
+	}
+	var written bool
+	err = b.transact(ctx, func(tx *sql.Tx) error {
+		existing, err := b.lookup(ctx, tx, name, k)
+		if err != nil {
+			return err
+		}
+		if !shouldReplace(existing) {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, b.supersedeSQL(name), args...); err != nil {
+			return err
+		}
+		b.filterAdd(name, k)
+		written = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return written, nil
+}
+
+// AddIf adds `value` to a set if no element with the same key is present.
+// Otherwise, `allow` is passed the stored element, and if it returns true,
+// `value` replaces it: for example, only if `value` is newer.
+// As with UpdateIf, this happens within a single transaction.
+// Returns true if `value` was written.
+func (b *Bigset[T]) AddIf(
+	ctx context.Context,
+	name string,
+	value T,
+	allow func(existing *T) bool,
+) (bool, error) {
+	return b.UpdateIf(ctx, name, value, func(existing *T) bool {
+		return existing == nil || allow(existing)
+	})
+}
+
+// SupersedeReturning stores `value` in a set in the same manner as
+// Supersede, returning the element it replaced, or nil if there was none.
+// The read and the write happen within a single transaction, so no other
+// writer can modify the element in between.
+func (b *Bigset[T]) SupersedeReturning(
+	ctx context.Context,
+	name string,
+	value T,
+) (previous *T, err error) {
+	if err := verifyNames(name); err != nil {
+		return nil, err
+	}
+	if !b.known(name) {
+		if err := b.initialise(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	k, args, err := b.row(&value)
+	if err != nil {
+		return nil, err
+	}
+	err = b.transact(ctx, func(tx *sql.Tx) error {
+		previous, err = b.lookup(ctx, tx, name, k)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, b.supersedeSQL(name), args...)
+		b.filterAdd(name, k)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// SupersedeClassified stores elements in a set in the same manner as
+// Supersede, but returns how many were newly inserted and how many
+// replaced an existing element with the same key, as determined within
+// a single transaction.
+func (b *Bigset[T]) SupersedeClassified(
+	ctx context.Context,
+	name string,
+	values ...T,
+) (inserted, updated int64, err error) {
+	if err := verifyNames(name); err != nil {
+		return -1, -1, err
+	}
+	if !b.known(name) {
+		if err := b.initialise(ctx, name); err != nil {
+			return -1, -1, err
+		}
+	}
+	written := make([][]byte, 0, len(values))
+	err = b.transact(ctx, func(tx *sql.Tx) error {
+		exists, err := tx.PrepareContext(ctx, fmt.Sprintf(
+			"SELECT EXISTS(SELECT 1 FROM \"%v\" WHERE k = ?%v)",
+			b.table(name),
+			b.expiry(" AND "),
+		))
+		if err != nil {
+			return err
+		}
+		defer exists.Close()
+		supersede, err := tx.PrepareContext(ctx, b.supersedeSQL(name))
+		if err != nil {
+			return err
+		}
+		defer supersede.Close()
+		for i := range values {
+			k, args, err := b.row(&values[i])
+			if err != nil {
+				return err
+			}
+			var found bool
+			if err := exists.QueryRowContext(ctx, k).Scan(&found); err != nil {
+				return err
+			}
+			if _, err := supersede.ExecContext(ctx, args...); err != nil {
+				return err
+			}
+			if found {
+				updated++
+			} else {
+				inserted++
+			}
+			written = append(written, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, -1, err
+	}
+	for _, k := range written {
+		b.filterAdd(name, k)
+	}
+	return inserted, updated, nil
+}
+
+// GetOrAdd adds `value` to a set unless an element with the same key
+// already exists, and returns the element which is stored under that key,
+// along with whether it was newly added.
+// This makes it possible to resolve an element to its canonical stored
+// form, even if a different element with the same key was stored first.
+func (b *Bigset[T]) GetOrAdd(
+	ctx context.Context,
+	name string,
+	value T,
+) (stored *T, inserted bool, err error) {
+	if err := verifyNames(name); err != nil {
+		return nil, false, err
+	}
+	if !b.known(name) {
+		if err := b.initialise(ctx, name); err != nil {
+			return nil, false, err
+		}
+	}
+	k, args, err := b.row(&value)
+	if err != nil {
+		return nil, false, err
+	}
+	err = b.transact(ctx, func(tx *sql.Tx) error {
+		execResult, err := tx.ExecContext(ctx, b.addSQL(name), args...)
+		if err != nil {
+			return err
+		}
+		ra, err := execResult.RowsAffected()
+		if err != nil {
+			return err
+		}
+		inserted = ra > 0
+		b.filterAdd(name, k)
+		if increment := b.incrementSQL(name); !inserted && increment != "" {
+			if _, err := tx.ExecContext(ctx, increment, k); err != nil {
+				return err
+			}
+		}
+		stored, err = b.lookup(ctx, tx, name, k)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return stored, inserted, nil
+}
+
+// UnionWith adds the elements of each source set to `target`, like Union,
+// but when an element's key is already present in `target`, `resolve` is
+// called with the stored element and the candidate, and whichever element
+// it returns is stored. Returning nil leaves the stored element in place.
+// Sources are merged in order, so a key present in several sources is
+// resolved once for each of them.
+// This is slower than Union, which should be preferred when keys never
+// collide. Returns the number of elements added or replaced.
+func (b *Bigset[T]) UnionWith(
+	ctx context.Context,
+	target string,
+	resolve func(existing, candidate *T) *T,
+	source ...string,
+) (int64, error) {
+	if err := verifyNames(target, source...); err != nil {
+		return -1, err
+	}
+	if err := b.found(ctx, source...); err != nil {
+		return -1, err
+	}
+	if !b.known(target) {
+		if err := b.initialise(ctx, target); err != nil {
+			return -1, err
+		}
+	}
+	defer b.forgetFilter(target)
+	var result int64
+	err := b.transact(ctx, func(tx *sql.Tx) error {
+		for _, s := range source {
+			if s == target {
+				continue
+			}
+			n, err := b.resolveCollisions(ctx, tx, target, s, resolve)
+			if err != nil {
+				return err
+			}
+			result += n
+			execResult, err := tx.ExecContext(ctx, fmt.Sprintf(
+				"INSERT OR IGNORE INTO \"%v\" (%v) SELECT %v FROM \"%v\"",
+				b.table(target),
+				b.columns(""),
+				b.columns(""),
+				b.table(s),
+			))
+			if err != nil {
+				return err
+			}
+			n, err = execResult.RowsAffected()
+			if err != nil {
+				return err
+			}
+			result += n
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	return result, nil
+}
+
+// collision is an element of a source set whose key is already present
+// in the target set.
+type collision struct {
+	k, existing, candidate []byte
+}
+
+// resolveCollisions calls `resolve` for each element of `source` whose key
+// is already present in `target`, storing the result.
+// Collisions are read a page at a time, ordered by key, so `target`
+// is never modified while it is being read.
+// Returns the number of replaced elements.
+func (b *Bigset[T]) resolveCollisions(
+	ctx context.Context,
+	tx *sql.Tx,
+	target, source string,
+	resolve func(existing, candidate *T) *T,
+) (int64, error) {
+	query := fmt.Sprintf(
+		"SELECT s.k, COALESCE(t.v, t.k), COALESCE(s.v, s.k) FROM \"%v\" s JOIN \"%v\" t ON s.k = t.k WHERE ? IS NULL OR s.k > ? ORDER BY s.k LIMIT ?",
+		b.table(source),
+		b.table(target),
+	)
+	update := fmt.Sprintf("UPDATE \"%v\" SET v = ?%v WHERE k = ?", b.table(target), b.extraAssignments(false))
+	var result int64
+	var after []byte // nil until the first page has been read
+	for {
+		page, err := readCollisions(ctx, tx, query, after, b.batchSize)
+		if err != nil {
+			return -1, err
+		}
+		for _, c := range page {
+			var existing, candidate T
+			if err := b.unmarshal(c.existing, &existing); err != nil {
+				return -1, err
+			}
+			if err := b.unmarshal(c.candidate, &candidate); err != nil {
+				return -1, err
+			}
+			winner := resolve(&existing, &candidate)
+			if winner == nil {
+				continue
+			}
+			k, args, err := b.row(winner)
+			if err != nil {
+				return -1, err
+			}
+			if !bytes.Equal(k, c.k) {
+				return -1, fmt.Errorf("the resolved element has key %q instead of %q.", k, c.k)
+			}
+			// the key is the last parameter rather than the first
+			if _, err := tx.ExecContext(ctx, update, append(args[1:], k)...); err != nil {
+				return -1, err
+			}
+			result++
+		}
+		if len(page) < b.batchSize {
+			return result, nil
+		}
+		after = page[len(page)-1].k
+	}
+}
+
+// readCollisions reads a single page of collisions.
+func readCollisions(
+	ctx context.Context,
+	tx *sql.Tx,
+	query string,
+	after []byte,
+	limit int,
+) ([]collision, error) {
+	rows, err := tx.QueryContext(ctx, query, after, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]collision, 0, limit)
+	for rows.Next() {
+		var c collision
+		if err := rows.Scan(&c.k, &c.existing, &c.candidate); err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
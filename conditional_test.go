@@ -0,0 +1,220 @@
+package bigset_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+// Versioned is identified by its ID, and carries a version which
+// increases each time it is modified.
+type Versioned struct {
+	ID      string
+	Version int
+}
+
+func versionedKey(v *Versioned) []byte {
+	return []byte(v.ID)
+}
+
+func TestUpdateIf(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Versioned](logger, bigset.WithKeyFunction(versionedKey))
+	require.Nil(t, err)
+
+	newer := func(candidate Versioned) func(*Versioned) bool {
+		return func(existing *Versioned) bool {
+			return existing == nil || existing.Version < candidate.Version
+		}
+	}
+
+	v := Versioned{ID: "a", Version: 2}
+	written, err := b.UpdateIf(ctx, "foo", v, newer(v))
+	require.Nil(t, err)
+	require.True(t, written)
+
+	// an older version is ignored
+	v = Versioned{ID: "a", Version: 1}
+	written, err = b.UpdateIf(ctx, "foo", v, newer(v))
+	require.Nil(t, err)
+	require.False(t, written)
+
+	stored, err := b.RetrieveIfExists(ctx, "foo", Versioned{ID: "a"})
+	require.Nil(t, err)
+	require.Equal(t, 2, stored.Version)
+
+	// a newer version replaces it
+	v = Versioned{ID: "a", Version: 3}
+	written, err = b.UpdateIf(ctx, "foo", v, newer(v))
+	require.Nil(t, err)
+	require.True(t, written)
+
+	stored, err = b.RetrieveIfExists(ctx, "foo", Versioned{ID: "a"})
+	require.Nil(t, err)
+	require.Equal(t, 3, stored.Version)
+
+	require.Nil(t, b.Close())
+}
+
+func TestAddIf(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Versioned](logger, bigset.WithKeyFunction(versionedKey))
+	require.Nil(t, err)
+
+	var calls int
+	newer := func(candidate Versioned) func(*Versioned) bool {
+		return func(existing *Versioned) bool {
+			calls++
+			return existing.Version < candidate.Version
+		}
+	}
+
+	// the predicate is only consulted when there is a stored element
+	v := Versioned{ID: "a", Version: 2}
+	written, err := b.AddIf(ctx, "foo", v, newer(v))
+	require.Nil(t, err)
+	require.True(t, written)
+	require.Equal(t, 0, calls)
+
+	v = Versioned{ID: "a", Version: 1}
+	written, err = b.AddIf(ctx, "foo", v, newer(v))
+	require.Nil(t, err)
+	require.False(t, written)
+
+	v = Versioned{ID: "a", Version: 3}
+	written, err = b.AddIf(ctx, "foo", v, newer(v))
+	require.Nil(t, err)
+	require.True(t, written)
+	require.Equal(t, 2, calls)
+
+	stored, err := b.RetrieveIfExists(ctx, "foo", Versioned{ID: "a"})
+	require.Nil(t, err)
+	require.Equal(t, 3, stored.Version)
+
+	require.Nil(t, b.Close())
+}
+
+func TestSupersedeReturning(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Versioned](logger, bigset.WithKeyFunction(versionedKey))
+	require.Nil(t, err)
+
+	previous, err := b.SupersedeReturning(ctx, "foo", Versioned{ID: "a", Version: 1})
+	require.Nil(t, err)
+	require.Nil(t, previous)
+
+	previous, err = b.SupersedeReturning(ctx, "foo", Versioned{ID: "a", Version: 2})
+	require.Nil(t, err)
+	require.Equal(t, Versioned{ID: "a", Version: 1}, *previous)
+
+	stored, err := b.RetrieveIfExists(ctx, "foo", Versioned{ID: "a"})
+	require.Nil(t, err)
+	require.Equal(t, 2, stored.Version)
+
+	require.Nil(t, b.Close())
+}
+
+func TestSupersedeClassified(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Versioned](logger, bigset.WithKeyFunction(versionedKey))
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", Versioned{"a", 1}, Versioned{"b", 1})
+	require.Nil(t, err)
+
+	inserted, updated, err := b.SupersedeClassified(
+		ctx,
+		"foo",
+		Versioned{"a", 2},
+		Versioned{"c", 1},
+		Versioned{"d", 1},
+		Versioned{"c", 2},
+	)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), inserted)
+	require.Equal(t, int64(2), updated)
+
+	stored, err := b.RetrieveIfExists(ctx, "foo", Versioned{ID: "c"})
+	require.Nil(t, err)
+	require.Equal(t, 2, stored.Version)
+	n, err := b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(4), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestGetOrAdd(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Versioned](logger, bigset.WithKeyFunction(versionedKey))
+	require.Nil(t, err)
+
+	stored, inserted, err := b.GetOrAdd(ctx, "foo", Versioned{ID: "a", Version: 1})
+	require.Nil(t, err)
+	require.True(t, inserted)
+	require.Equal(t, Versioned{ID: "a", Version: 1}, *stored)
+
+	// the first element stored under the key wins
+	stored, inserted, err = b.GetOrAdd(ctx, "foo", Versioned{ID: "a", Version: 2})
+	require.Nil(t, err)
+	require.False(t, inserted)
+	require.Equal(t, Versioned{ID: "a", Version: 1}, *stored)
+
+	require.Nil(t, b.Close())
+}
+
+func TestUnionWith(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Versioned](
+		logger,
+		bigset.WithKeyFunction(versionedKey),
+		bigset.WithInsertBatchSize[Versioned](2),
+	)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "first", Versioned{ID: "a", Version: 1}, Versioned{ID: "b", Version: 5})
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "second", Versioned{ID: "a", Version: 3}, Versioned{ID: "b", Version: 2})
+	require.Nil(t, err)
+	_, err = b.Add(
+		ctx,
+		"third",
+		Versioned{ID: "a", Version: 2},
+		Versioned{ID: "c", Version: 1},
+		Versioned{ID: "d", Version: 1},
+		Versioned{ID: "e", Version: 1},
+	)
+	require.Nil(t, err)
+
+	newest := func(existing, candidate *Versioned) *Versioned {
+		if candidate.Version > existing.Version {
+			return candidate
+		}
+		return nil
+	}
+	n, err := b.UnionWith(ctx, "merged", newest, "first", "second", "third")
+	require.Nil(t, err)
+	// a and b from first, a replaced by second, c, d and e from third
+	require.Equal(t, int64(6), n)
+
+	merged, err := b.Get(ctx, "merged")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []Versioned{
+		{ID: "a", Version: 3},
+		{ID: "b", Version: 5},
+		{ID: "c", Version: 1},
+		{ID: "d", Version: 1},
+		{ID: "e", Version: 1},
+	}, *merged)
+
+	// the resolved element must keep its key
+	rename := func(existing, candidate *Versioned) *Versioned {
+		return &Versioned{ID: "z"}
+	}
+	_, err = b.UnionWith(ctx, "merged", rename, "first")
+	require.Error(t, err)
+
+	require.Nil(t, b.Close())
+}
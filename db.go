@@ -0,0 +1,109 @@
+package bigset
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/url"
+	"runtime"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nicois/fastdb"
+)
+
+// database is a pair of sqlite3 clients, in the same manner as fastdb:
+// a reader which supports parallel operations, and a writer which
+// only supports one write at a time. Unlike fastdb, the connection
+// parameters can be adjusted, and are applied to every connection.
+type database struct {
+	reader *sql.DB
+	writer *sql.DB
+}
+
+// Close closes both of the underlying clients.
+func (d *database) Close() error {
+	if d.writer != nil {
+		if err := d.writer.Close(); err != nil {
+			return err
+		}
+	}
+	if d.reader != nil {
+		if err := d.reader.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reader returns the client used for queries.
+func (d *database) Reader() *sql.DB {
+	return d.reader
+}
+
+// Writer returns the client used for modifications.
+func (d *database) Writer() *sql.DB {
+	return d.writer
+}
+
+// defaultConnectionParams returns the same connection parameters as fastdb.
+func defaultConnectionParams() url.Values {
+	params := make(url.Values)
+	params.Set("_txlock", "immediate")
+	params.Set("_journal_mode", "WAL")
+	params.Set("_busy_timeout", "5000")
+	params.Set("_synchronous", "NORMAL")
+	params.Set("_cache_size", "1000000000")
+	params.Set("_foreign_keys", "true")
+	return params
+}
+
+// open creates the sqlite3 clients for the database located at filename.
+func open(filename string, params url.Values) (fastdb.FastDB, error) {
+	connectionURL := fmt.Sprintf("file:%v?", filename) + params.Encode()
+	d := &database{}
+	writer, err := sql.Open("sqlite3", connectionURL)
+	if err != nil {
+		return nil, err
+	}
+	writer.SetMaxOpenConns(1)
+	d.writer = writer
+	if _, err := writer.Exec("PRAGMA temp_store = memory"); err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+	reader, err := sql.Open("sqlite3", connectionURL)
+	if err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+	reader.SetMaxOpenConns(max(4, runtime.NumCPU()))
+	d.reader = reader
+	if _, err := reader.Exec("PRAGMA temp_store = memory"); err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// closedConnector refuses every connection, so that a Bigset which has
+// been closed returns ErrClosed rather than dereferencing a nil database.
+type closedConnector struct{}
+
+func (closedConnector) Connect(context.Context) (driver.Conn, error) {
+	return nil, ErrClosed
+}
+
+func (c closedConnector) Driver() driver.Driver {
+	return c
+}
+
+func (closedConnector) Open(string) (driver.Conn, error) {
+	return nil, ErrClosed
+}
+
+// closedDatabase replaces the database of a Bigset once it is closed.
+var closedDatabase = &database{
+	reader: sql.OpenDB(closedConnector{}),
+	writer: sql.OpenDB(closedConnector{}),
+}
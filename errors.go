@@ -0,0 +1,40 @@
+package bigset
+
+import "errors"
+
+// ErrInvalidName is returned when a set name cannot be used.
+// Names must be non-empty, and consist only of ASCII letters, digits,
+// spaces, underscores, periods and hyphens. Names beginning with
+// "sqlite_" are reserved.
+var ErrInvalidName = errors.New("invalid set name")
+
+// ErrSetNotFound is returned by operations which require a set to exist,
+// when it does not.
+var ErrSetNotFound = errors.New("set not found")
+
+// ErrSchemaMismatch is returned by Create when the database was created
+// with a different schema version to the one given by WithSchemaVersion.
+var ErrSchemaMismatch = errors.New("schema version mismatch")
+
+// ErrValueTooLarge is returned when an element is too large to be stored,
+// either by sqlite or because of WithMaxValueSize.
+var ErrValueTooLarge = errors.New("value too large")
+
+// ErrDuplicateKey is returned by AddStrict when an element has the same
+// key as one which is already present.
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// ErrClosed is returned when a Bigset is used after it has been closed.
+var ErrClosed = errors.New("bigset is closed")
+
+// ErrReadOnly is returned when attempting to modify a Bigset which was
+// opened using WithReadOnly.
+var ErrReadOnly = errors.New("bigset was opened read-only")
+
+// writable returns ErrReadOnly if the Bigset may not be modified.
+func (b *Bigset[T]) writable() error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package bigset
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Export writes every item of a set to `w` as newline-delimited JSON,
+// one item per line. Rows are streamed from the database, so arbitrarily
+// large sets can be exported. As with DumpAll, expired items are skipped.
+// Items are always written as JSON: if WithCodec was used, each is decoded
+// with the codec and then encoded as JSON, so that the output can be read
+// by other tools.
+// Returns the number of items written.
+func (b *Bigset[T]) Export(ctx context.Context, name string, w io.Writer) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return -1, err
+	}
+	rows, err := b.db.Reader().QueryContext(
+		ctx,
+		fmt.Sprintf("SELECT COALESCE(v, k) FROM \"%v\"%v", b.table(name), b.expiry(" WHERE ")),
+	)
+	if err != nil {
+		return -1, err
+	}
+	defer rows.Close()
+	writer := bufio.NewWriter(w)
+	result, err := b.writeLines(ctx, rows, writer)
+	if err != nil {
+		return -1, err
+	}
+	if err := writer.Flush(); err != nil {
+		return -1, err
+	}
+	return result, nil
+}
+
+// writeLines writes the first column of each remaining row to `w` as
+// JSON, followed by a newline, converting it from the codec's encoding
+// if there is one. Returns the number of rows written.
+func (b *Bigset[T]) writeLines(ctx context.Context, rows *sql.Rows, w *bufio.Writer) (int64, error) {
+	var result int64
+	rawRow := sql.RawBytes{}
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return -1, err
+		}
+		if err := rows.Scan(&rawRow); err != nil {
+			return -1, err
+		}
+		line := []byte(rawRow)
+		if b.codec != nil {
+			var value T
+			if err := b.codec.Unmarshal(rawRow, &value); err != nil {
+				return -1, err
+			}
+			var err error
+			if line, err = json.Marshal(&value); err != nil {
+				return -1, err
+			}
+		}
+		// values are written as compact JSON, so contain no newlines
+		if _, err := w.Write(line); err != nil {
+			return -1, err
+		}
+		if err := w.WriteByte('\n'); err != nil {
+			return -1, err
+		}
+		result++
+	}
+	if err := rows.Err(); err != nil {
+		return -1, err
+	}
+	return result, nil
+}
+
+// Import reads newline-delimited JSON from `r`, adding each item to
+// the named set with the same semantics as Add. Blank lines are ignored.
+// Each line is decoded as JSON even if WithCodec was used, in which case
+// the item is stored using the codec, so anything written by Export can
+// be imported.
+// Items are inserted in batches, each within a single transaction.
+// Returns the number of items actually added.
+func (b *Bigset[T]) Import(ctx context.Context, name string, r io.Reader) (int64, error) {
+	return b.load(ctx, name, bufio.NewReader(r), -1)
+}
+
+// load reads `count` items from `reader` as newline-delimited JSON,
+// or every remaining item if `count` is negative, adding them to the
+// named set with the same semantics as Add.
+// Returns the number of items actually added.
+func (b *Bigset[T]) load(ctx context.Context, name string, reader *bufio.Reader, count int64) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if !b.known(name) {
+		if err := b.initialise(ctx, name); err != nil {
+			return -1, err
+		}
+	}
+	batch := b.newAddBatch(name)
+	defer batch.rollback()
+	// the total is only known when loading an archive
+	total := count
+	var loaded int64
+	for lineNumber := 1; count != 0; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return -1, err
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			var value T
+			if err := json.Unmarshal(trimmed, &value); err != nil {
+				return -1, fmt.Errorf("line %v is malformed: %w", lineNumber, err)
+			}
+			if _, err := batch.add(ctx, &value); err != nil {
+				return -1, err
+			}
+			count--
+			loaded++
+			if b.progress != nil && loaded%progressInterval == 0 {
+				b.progress(loaded, total)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			if count > 0 {
+				return -1, fmt.Errorf("%v is missing %v items.", name, count)
+			}
+			break
+		}
+	}
+	if err := batch.commit(); err != nil {
+		return -1, err
+	}
+	if b.progress != nil {
+		b.progress(loaded, loaded)
+	}
+	return batch.affected, nil
+}
+
+// archiveMagic begins every archive written by DumpAll, and is
+// followed by a single byte giving the archive's format version.
+const archiveMagic = "BIGSET"
+
+// archiveVersion is the format version written by DumpAll.
+const archiveVersion byte = 1
+
+// archiveHeader precedes the items of each set in an archive.
+type archiveHeader struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// DumpAll writes every set to `w` as a single archive, which can be
+// restored with LoadAll. After a short header, each set is written as a
+// line of JSON giving its name and size, followed by its items as
+// newline-delimited JSON, as with Export.
+// Everything is read within a single transaction, so the archive is
+// consistent even if the sets are modified concurrently, as long as the
+// database uses WAL mode.
+func (b *Bigset[T]) DumpAll(ctx context.Context, w io.Writer) error {
+	conn, release, err := b.snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// the sets are listed within the snapshot, so that any created or
+	// dropped concurrently are either entirely present or entirely absent
+	names, err := b.listSets(ctx, conn)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(w)
+	if _, err := writer.WriteString(archiveMagic); err != nil {
+		return err
+	}
+	if err := writer.WriteByte(archiveVersion); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	for _, name := range names {
+		header := archiveHeader{Name: name}
+		err := conn.QueryRowContext(
+			ctx,
+			fmt.Sprintf("SELECT COUNT(*) FROM \"%v\"%v", b.table(name), b.expiry(" WHERE ")),
+		).Scan(&header.Count)
+		if err != nil {
+			return err
+		}
+		if err := encoder.Encode(header); err != nil {
+			return err
+		}
+		rows, err := conn.QueryContext(
+			ctx,
+			fmt.Sprintf("SELECT COALESCE(v, k) FROM \"%v\"%v", b.table(name), b.expiry(" WHERE ")),
+		)
+		if err != nil {
+			return err
+		}
+		_, err = b.writeLines(ctx, rows, writer)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// LoadAll restores every set from an archive written by DumpAll,
+// adding their items with the same semantics as Add. Sets which are
+// not in the archive are left as they are.
+func (b *Bigset[T]) LoadAll(ctx context.Context, r io.Reader) error {
+	reader := bufio.NewReader(r)
+	prefix := make([]byte, len(archiveMagic)+1)
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return fmt.Errorf("could not read the archive header: %w", err)
+	}
+	if string(prefix[:len(archiveMagic)]) != archiveMagic {
+		return errors.New("this is not a bigset archive.")
+	}
+	if version := prefix[len(archiveMagic)]; version != archiveVersion {
+		return fmt.Errorf("unsupported archive version %v.", version)
+	}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(bytes.TrimSpace(line)) == 0 {
+			return nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		var header archiveHeader
+		if err := json.Unmarshal(line, &header); err != nil {
+			return fmt.Errorf("a set header is malformed: %w", err)
+		}
+		if _, err := b.load(ctx, header.Name, reader, header.Count); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package bigset_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](logger)
+	require.Nil(t, err)
+
+	martin := Book{Name: "Martin the Warrior", Pages: 375, Favourite: true}
+	mossflower := Book{Name: "Mossflower", Pages: 420}
+	_, err = b.Add(ctx, "books", martin, mossflower)
+	require.Nil(t, err)
+
+	var buffer bytes.Buffer
+	n, err := b.Export(ctx, "books", &buffer)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	books := make([]Book, 0, len(lines))
+	for _, line := range lines {
+		var book Book
+		require.Nil(t, json.Unmarshal([]byte(line), &book))
+		books = append(books, book)
+	}
+	require.ElementsMatch(t, []Book{martin, mossflower}, books)
+
+	require.Nil(t, b.Close())
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](logger)
+	require.Nil(t, err)
+
+	input := `{"Name":"Mossflower","Pages":420}
+
+{"Name":"Salamandastron","Pages":336}
+{"Name":"Mossflower","Pages":420}
+{"Name":"Redwall","Pages":351}`
+	n, err := b.Import(ctx, "books", strings.NewReader(input))
+	require.Nil(t, err)
+	// one of the lines is a duplicate
+	require.Equal(t, int64(3), n)
+
+	book, err := b.RetrieveIfExists(ctx, "books", Book{Name: "Redwall", Pages: 351})
+	require.Nil(t, err)
+	require.NotNil(t, book)
+
+	// round-trip via Export
+	var buffer bytes.Buffer
+	_, err = b.Export(ctx, "books", &buffer)
+	require.Nil(t, err)
+	n, err = b.Import(ctx, "copy", &buffer)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	// malformed lines identify themselves
+	_, err = b.Import(ctx, "broken", strings.NewReader("{\"Name\":\"ok\"}\n{oops\n"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "line 2")
+
+	require.Nil(t, b.Close())
+}
+
+func TestExportImportCodec(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[string](logger, bigset.WithCodec(bigset.StringCodec()))
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "src", "foo", "bar \"baz\"")
+	require.Nil(t, err)
+
+	// exports are JSON, which Import stores using the codec
+	var buffer bytes.Buffer
+	n, err := b.Export(ctx, "src", &buffer)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+	require.Contains(t, buffer.String(), `"bar \"baz\""`)
+	n, err = b.Import(ctx, "dst", &buffer)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+	equal, err := b.Equals(ctx, "src", "dst")
+	require.Nil(t, err)
+	require.True(t, equal)
+
+	require.Nil(t, b.Close())
+}
+
+func TestDumpAll(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](logger)
+	require.Nil(t, err)
+
+	martin := Book{Name: "Martin the Warrior", Pages: 375, Favourite: true}
+	mossflower := Book{Name: "Mossflower", Pages: 420}
+	redwall := Book{Name: "Redwall", Pages: 352}
+	_, err = b.Add(ctx, "books", martin, mossflower)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "favourites", martin)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "empty", redwall)
+	require.Nil(t, err)
+	_, err = b.Discard(ctx, "empty", redwall)
+	require.Nil(t, err)
+
+	var buffer bytes.Buffer
+	require.Nil(t, b.DumpAll(ctx, &buffer))
+	archive := buffer.Bytes()
+	require.Nil(t, b.Close())
+
+	restored, err := bigset.Create[Book](logger)
+	require.Nil(t, err)
+	_, err = restored.Add(ctx, "books", redwall)
+	require.Nil(t, err)
+	require.Nil(t, restored.LoadAll(ctx, bytes.NewReader(archive)))
+
+	sets, err := restored.ListSets(ctx)
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"books", "empty", "favourites"}, sets)
+	books, err := restored.Get(ctx, "books")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []Book{martin, mossflower, redwall}, *books)
+	favourites, err := restored.Get(ctx, "favourites")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []Book{martin}, *favourites)
+
+	// truncated archives and other files are rejected
+	require.Error(t, restored.LoadAll(ctx, bytes.NewReader(archive[:len(archive)-5])))
+	require.Error(t, restored.LoadAll(ctx, strings.NewReader("{\"Name\":\"Redwall\"}\n")))
+
+	require.Nil(t, restored.Close())
+}
@@ -1,8 +1,9 @@
 module github.com/nicois/bigset
 
-go 1.22.7
+go 1.23
 
 require (
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/nicois/fastdb v0.0.0-20240511060213-776b25c4dbb9
 	github.com/stretchr/testify v1.8.1
 	go.uber.org/zap v1.27.0
@@ -10,7 +11,6 @@ require (
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/mattn/go-sqlite3 v1.14.22 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
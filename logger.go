@@ -0,0 +1,32 @@
+package bigset
+
+import "go.uber.org/zap"
+
+// Logger receives the warnings emitted by a Bigset. Each warning is
+// accompanied by alternating keys and values, in the same manner as
+// *slog.Logger, which can be used directly.
+type Logger interface {
+	Warn(msg string, keysAndValues ...any)
+}
+
+// ZapLogger adapts a zap logger so it can be used with WithLogger.
+// A nil logger discards everything.
+func ZapLogger(logger *zap.Logger) Logger {
+	if logger == nil {
+		return nopLogger{}
+	}
+	return zapLogger{logger.Sugar()}
+}
+
+type zapLogger struct {
+	sugar *zap.SugaredLogger
+}
+
+func (z zapLogger) Warn(msg string, keysAndValues ...any) {
+	z.sugar.Warnw(msg, keysAndValues...)
+}
+
+// nopLogger discards everything.
+type nopLogger struct{}
+
+func (nopLogger) Warn(string, ...any) {}
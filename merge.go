@@ -0,0 +1,130 @@
+package bigset
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// EachMerged walks the keys of two sets together in ascending order,
+// calling `f` once for each distinct key present in either of them, along
+// with whether it is present in `first` and in `second`.
+// This is a full outer merge join, so differences and merges can be
+// computed in a single pass without creating intermediate sets.
+// Both sets are read within a single read transaction, so they are
+// consistent with each other. A set which does not exist is treated
+// as empty.
+func (b *Bigset[T]) EachMerged(
+	ctx context.Context,
+	first, second string,
+	f func(ctx context.Context, key []byte, inFirst, inSecond bool) error,
+) error {
+	if err := verifyNames(first, second); err != nil {
+		return err
+	}
+	if err := b.found(ctx, first, second); err != nil {
+		return err
+	}
+	conn, release, err := b.snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	a, err := b.openKeyCursor(ctx, conn, first)
+	if err != nil {
+		return err
+	}
+	defer a.close()
+	z, err := b.openKeyCursor(ctx, conn, second)
+	if err != nil {
+		return err
+	}
+	defer z.close()
+	for !a.done || !z.done {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var order int
+		switch {
+		case a.done:
+			order = 1
+		case z.done:
+			order = -1
+		default:
+			order = bytes.Compare(a.key, z.key)
+		}
+		key := a.key
+		if order > 0 {
+			key = z.key
+		}
+		if err := f(ctx, key, order <= 0, order >= 0); err != nil {
+			return err
+		}
+		if order <= 0 {
+			if err := a.advance(); err != nil {
+				return err
+			}
+		}
+		if order >= 0 {
+			if err := z.advance(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// keyCursor reads the keys of a set in ascending order, one at a time.
+type keyCursor struct {
+	rows *sql.Rows // nil if the set does not exist
+	key  []byte
+	done bool
+}
+
+// openKeyCursor returns a cursor positioned at the first key of the named
+// set, reading it using `conn`.
+func (b *Bigset[T]) openKeyCursor(ctx context.Context, conn *sql.Conn, name string) (*keyCursor, error) {
+	c := &keyCursor{}
+	exists, err := tableExists(ctx, conn, b.table(name))
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		c.rows, err = conn.QueryContext(
+			ctx,
+			fmt.Sprintf("SELECT k FROM \"%v\"%v ORDER BY k", b.table(name), b.expiry(" WHERE ")),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := c.advance(); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// advance moves the cursor to the next key, setting `done` once there
+// are none left.
+func (c *keyCursor) advance() error {
+	if c.rows == nil || !c.rows.Next() {
+		c.done = true
+		c.key = nil
+		if c.rows != nil {
+			return c.rows.Err()
+		}
+		return nil
+	}
+	// scanning into a []byte copies the key, so it remains valid
+	// once the cursor has moved on
+	return c.rows.Scan(&c.key)
+}
+
+// close releases the cursor's query, if any.
+func (c *keyCursor) close() {
+	if c.rows != nil {
+		_ = c.rows.Close()
+	}
+}
@@ -0,0 +1,59 @@
+package bigset_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEachMerged(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "first", 1, 2, 3, 5)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "second", 2, 4, 5, 6)
+	require.Nil(t, err)
+
+	type visit struct {
+		key               string
+		inFirst, inSecond bool
+	}
+	var visits []visit
+	record := func(ctx context.Context, key []byte, inFirst, inSecond bool) error {
+		visits = append(visits, visit{string(key), inFirst, inSecond})
+		return nil
+	}
+	require.Nil(t, b.EachMerged(ctx, "first", "second", record))
+	require.Equal(t, []visit{
+		{"1", true, false},
+		{"2", true, true},
+		{"3", true, false},
+		{"4", false, true},
+		{"5", true, true},
+		{"6", false, true},
+	}, visits)
+
+	// missing sets are treated as empty
+	visits = nil
+	require.Nil(t, b.EachMerged(ctx, "missing", "first", record))
+	require.Equal(t, []visit{
+		{"1", false, true},
+		{"2", false, true},
+		{"3", false, true},
+		{"5", false, true},
+	}, visits)
+
+	// an error from the callback stops the walk
+	stop := errors.New("stop")
+	err = b.EachMerged(ctx, "first", "second", func(context.Context, []byte, bool, bool) error {
+		return stop
+	})
+	require.ErrorIs(t, err, stop)
+
+	require.Nil(t, b.Close())
+}
@@ -0,0 +1,109 @@
+package bigset
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// setMetadataTable holds annotations for individual sets.
+const setMetadataTable = "bigset:set metadata"
+
+// tableExists returns true if the named table exists. Unlike exists,
+// this is not cached, so is suitable for tables which are not sets.
+func tableExists(ctx context.Context, q queryer, name string) (bool, error) {
+	var result bool
+	err := q.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)",
+		name,
+	).Scan(&result)
+	return result, err
+}
+
+// SetMetadata attaches a value to a set under `key`, replacing any
+// value previously stored under that key. This is useful for recording
+// provenance, such as when or how a set was created.
+// It is an error for the set not to exist.
+func (b *Bigset[T]) SetMetadata(ctx context.Context, name, key, value string) error {
+	if err := verifyNames(name); err != nil {
+		return err
+	}
+	if err := b.writable(); err != nil {
+		return err
+	}
+	exists, err := b.exists(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: %v.", ErrSetNotFound, name)
+	}
+	sql := fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS \"%v\" (name TEXT, key TEXT, value TEXT, PRIMARY KEY (name, key));",
+		b.table(setMetadataTable),
+	)
+	if _, err := b.db.Writer().ExecContext(ctx, sql); err != nil {
+		return err
+	}
+	sql = fmt.Sprintf(
+		"INSERT OR REPLACE INTO \"%v\"(name, key, value) VALUES (?, ?, ?);",
+		b.table(setMetadataTable),
+	)
+	_, err = b.db.Writer().ExecContext(ctx, sql, name, key, value)
+	return err
+}
+
+// GetMetadata returns the value attached to a set under `key`,
+// and whether there was one.
+func (b *Bigset[T]) GetMetadata(ctx context.Context, name, key string) (string, bool, error) {
+	if err := verifyNames(name); err != nil {
+		return "", false, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return "", false, err
+	}
+	exists, err := tableExists(ctx, b.db.Reader(), b.table(setMetadataTable))
+	if err != nil || !exists {
+		return "", false, err
+	}
+	var value string
+	err = b.db.Reader().QueryRowContext(
+		ctx,
+		fmt.Sprintf("SELECT value FROM \"%v\" WHERE name = ? AND key = ?", b.table(setMetadataTable)),
+		name,
+		key,
+	).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// moveMetadata reassigns the metadata of one set to another,
+// discarding it if `newName` is empty.
+func (b *Bigset[T]) moveMetadata(ctx context.Context, tx *sql.Tx, oldName, newName string) error {
+	exists, err := tableExists(ctx, tx, b.table(setMetadataTable))
+	if err != nil || !exists {
+		return err
+	}
+	if newName == "" {
+		_, err = tx.ExecContext(
+			ctx,
+			fmt.Sprintf("DELETE FROM \"%v\" WHERE name = ?", b.table(setMetadataTable)),
+			oldName,
+		)
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		fmt.Sprintf("UPDATE \"%v\" SET name = ? WHERE name = ?", b.table(setMetadataTable)),
+		newName,
+		oldName,
+	)
+	return err
+}
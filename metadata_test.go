@@ -0,0 +1,61 @@
+package bigset_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadata(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger, bigset.WithSchemaVersion[int]("1"))
+	require.Nil(t, err)
+
+	_, ok, err := b.GetMetadata(ctx, "foo", "source")
+	require.Nil(t, err)
+	require.False(t, ok)
+	require.ErrorIs(t, b.SetMetadata(ctx, "foo", "source", "test"), bigset.ErrSetNotFound)
+
+	_, err = b.Add(ctx, "foo", 1)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "bar", 2)
+	require.Nil(t, err)
+	require.Nil(t, b.SetMetadata(ctx, "foo", "source", "test"))
+	require.Nil(t, b.SetMetadata(ctx, "foo", "source", "replaced"))
+	value, ok, err := b.GetMetadata(ctx, "foo", "source")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, "replaced", value)
+
+	// the metadata tables are not sets
+	names, err := b.ListSets(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []string{"bar", "foo"}, names)
+
+	// metadata follows a renamed set
+	require.Nil(t, b.RenameSet(ctx, "foo", "baz"))
+	value, ok, err = b.GetMetadata(ctx, "baz", "source")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, "replaced", value)
+	_, ok, err = b.GetMetadata(ctx, "foo", "source")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// and is removed along with it
+	require.Nil(t, b.DropSet(ctx, "baz"))
+	_, ok, err = b.GetMetadata(ctx, "baz", "source")
+	require.Nil(t, err)
+	require.False(t, ok)
+	names, err = b.ListSets(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []string{"bar"}, names)
+	empty, err := b.IsEmpty(ctx, "baz")
+	require.Nil(t, err)
+	require.True(t, empty)
+	require.Nil(t, b.DropSet(ctx, "missing"))
+
+	require.Nil(t, b.Close())
+}
@@ -0,0 +1,138 @@
+package bigset
+
+import (
+	"context"
+	"time"
+)
+
+// MetricsObserver is told about each operation performed by a Bigset,
+// so that it can be exported to a monitoring system such as Prometheus
+// or OpenTelemetry.
+type MetricsObserver interface {
+	// ObserveOp is called once an operation has completed, with the
+	// number of elements it affected or visited, which is -1 if the
+	// operation failed, and how long it took.
+	ObserveOp(op string, n int64, d time.Duration)
+}
+
+// WithMetrics reports the duration and size of operations to `observer`.
+// Operations which are composed of others, such as Get, report each of
+// those instead. If this is not used, nothing is measured.
+func WithMetrics[T any](observer MetricsObserver) option[T] {
+	return func(b *Bigset[T]) error {
+		b.metrics = observer
+		return nil
+	}
+}
+
+// Tracer starts a span for each operation performed by a Bigset.
+// This allows operations to be seen in distributed traces without this
+// package depending on a particular tracing library. For example, an
+// OpenTelemetry trace.Tracer can be adapted like so:
+//
+//	type otelTracer struct{ trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, bigset.Span) {
+//		ctx, span := t.Tracer.Start(ctx, name)
+//		return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ trace.Span }
+//
+//	func (s otelSpan) SetAttribute(key string, value any) {
+//		s.Span.SetAttributes(attribute.String(key, fmt.Sprint(value)))
+//	}
+type Tracer interface {
+	// Start begins a span with the given name, returning a context
+	// which carries it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single operation within a trace.
+type Span interface {
+	SetAttribute(key string, value any)
+	End()
+}
+
+// WithTracer starts a span for each operation, named after the operation,
+// such as "bigset.Union". Each span has the name of the set being read or
+// modified as its "bigset.set" attribute, and the number of elements
+// affected or visited as its "bigset.rows" attribute, as reported by
+// WithMetrics. Whether spans are recorded when `ctx` does not carry a
+// trace is up to `tracer`.
+func WithTracer[T any](tracer Tracer) option[T] {
+	return func(b *Bigset[T]) error {
+		b.tracer = tracer
+		return nil
+	}
+}
+
+// observed returns true if operations are being measured or traced.
+func (b *Bigset[T]) observed() bool {
+	return b.metrics != nil || b.tracer != nil
+}
+
+// observe starts measuring and tracing an operation on the named set,
+// returning the context in which it should be performed. The returned
+// function must be called with its result once it has completed, which
+// is usually done by deferring it.
+func (b *Bigset[T]) observe(ctx context.Context, op, name string) (context.Context, func(n *int64)) {
+	if !b.observed() {
+		return ctx, unobserved
+	}
+	start := time.Now()
+	var span Span
+	if b.tracer != nil {
+		ctx, span = b.tracer.Start(ctx, "bigset."+op)
+		span.SetAttribute("bigset.set", name)
+	}
+	return ctx, func(n *int64) {
+		if b.metrics != nil {
+			b.metrics.ObserveOp(op, *n, time.Since(start))
+		}
+		if span != nil {
+			span.SetAttribute("bigset.rows", *n)
+			span.End()
+		}
+	}
+}
+
+func unobserved(*int64) {}
+
+// progressInterval is the number of elements visited or loaded between
+// each report to the function given to WithProgress.
+const progressInterval = 10_000
+
+// WithProgress reports the progress of long-running operations to `fn`,
+// such as to drive a progress bar. Each, Import and LoadAll call it every
+// 10,000 elements with the number visited or loaded so far, along with the
+// total expected, which is -1 if it is not known in advance, as when
+// importing.
+// Union, Intersection, Difference and the other operations performed
+// entirely by sqlite cannot report their progress, so call it once as they
+// start, with a total of -1.
+// Once an operation has completed successfully, it is called a final time
+// with `done` equal to `total`.
+func WithProgress[T any](fn func(done, total int64)) option[T] {
+	return func(b *Bigset[T]) error {
+		b.progress = fn
+		return nil
+	}
+}
+
+// track reports that an operation performed entirely by sqlite has started.
+// The returned function must be called with its result once it has
+// completed, which reports its completion if it succeeded.
+func (b *Bigset[T]) track() func(n *int64) {
+	if b.progress == nil {
+		return untracked
+	}
+	b.progress(0, -1)
+	return func(n *int64) {
+		if *n >= 0 {
+			b.progress(*n, *n)
+		}
+	}
+}
+
+func untracked(*int64) {}
@@ -0,0 +1,133 @@
+package bigset_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+type observation struct {
+	op string
+	n  int64
+}
+
+type recorder struct {
+	observations []observation
+}
+
+func (r *recorder) ObserveOp(op string, n int64, d time.Duration) {
+	r.observations = append(r.observations, observation{op: op, n: n})
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	r := &recorder{}
+	b, err := bigset.Create[int](logger, bigset.WithMetrics[int](r))
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	_, err = b.Union(ctx, "bar", "foo")
+	require.Nil(t, err)
+	_, err = b.Discard(ctx, "bar", 1)
+	require.Nil(t, err)
+	var buffer int
+	err = b.Each(ctx, "bar", &buffer, func(ctx context.Context) error { return nil })
+	require.Nil(t, err)
+	_, err = b.Union(ctx, "bar", "missing")
+	require.Error(t, err)
+
+	require.Equal(t, []observation{
+		{op: "Add", n: 3},
+		{op: "Union", n: 3},
+		{op: "Discard", n: 1},
+		{op: "Each", n: 2},
+		{op: "Union", n: -1},
+	}, r.observations)
+
+	require.Nil(t, b.Close())
+}
+
+type span struct {
+	name       string
+	attributes map[string]any
+	ended      bool
+}
+
+func (s *span) SetAttribute(key string, value any) {
+	s.attributes[key] = value
+}
+
+func (s *span) End() {
+	s.ended = true
+}
+
+type tracer struct {
+	spans []*span
+}
+
+func (t *tracer) Start(ctx context.Context, name string) (context.Context, bigset.Span) {
+	s := &span{name: name, attributes: map[string]any{}}
+	t.spans = append(t.spans, s)
+	return ctx, s
+}
+
+func TestTracer(t *testing.T) {
+	ctx := context.Background()
+	tr := &tracer{}
+	b, err := bigset.Create[int](logger, bigset.WithTracer[int](tr))
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3)
+	require.Nil(t, err)
+	_, err = b.Intersection(ctx, "bar", "foo")
+	require.Nil(t, err)
+
+	require.Equal(t, []*span{
+		{name: "bigset.Add", attributes: map[string]any{"bigset.set": "foo", "bigset.rows": int64(3)}, ended: true},
+		{name: "bigset.Intersection", attributes: map[string]any{"bigset.set": "bar", "bigset.rows": int64(3)}, ended: true},
+	}, tr.spans)
+
+	require.Nil(t, b.Close())
+}
+
+func TestProgress(t *testing.T) {
+	ctx := context.Background()
+	type report struct{ done, total int64 }
+	var reports []report
+	b, err := bigset.Create[int](logger, bigset.WithProgress[int](func(done, total int64) {
+		reports = append(reports, report{done, total})
+	}))
+	require.Nil(t, err)
+
+	values := make([]int, 25_000)
+	for i := range values {
+		values[i] = i
+	}
+	_, err = b.AddSlice(ctx, "foo", values)
+	require.Nil(t, err)
+	require.Empty(t, reports)
+
+	var buffer int
+	err = b.Each(ctx, "foo", &buffer, func(ctx context.Context) error { return nil })
+	require.Nil(t, err)
+	require.Equal(t, []report{{10_000, 25_000}, {20_000, 25_000}, {25_000, 25_000}}, reports)
+
+	// operations performed by sqlite only report when they start and finish
+	reports = nil
+	_, err = b.Union(ctx, "bar", "foo")
+	require.Nil(t, err)
+	require.Equal(t, []report{{0, -1}, {25_000, 25_000}}, reports)
+
+	// small imports only report their completion
+	reports = nil
+	_, err = b.Import(ctx, "baz", strings.NewReader("1\n2\n3\n"))
+	require.Nil(t, err)
+	require.Equal(t, []report{{3, 3}}, reports)
+
+	require.Nil(t, b.Close())
+}
@@ -0,0 +1,73 @@
+package bigset
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// WithMultiplicity counts how many times each element has been added to
+// a set, even though only the first is stored. This is useful with a key
+// function which maps many different items to the same key, turning the
+// set into a frequency table. Adding an element with Add, AddSlice,
+// AddReturning, GetOrAdd, Import or the transformations, such as Map,
+// increments the count if its key is already present.
+// Other operations, such as Supersede and Union, do not change the count
+// of existing elements, and elements they add have a count of one.
+// This only applies to sets created while this option is in use.
+func WithMultiplicity[T any]() option[T] {
+	return func(b *Bigset[T]) error {
+		b.multiplicity = true
+		return nil
+	}
+}
+
+// incrementSQL returns the statement used to record that an element was
+// added to the named set when its key was already present, or nothing
+// if this is not being recorded.
+func (b *Bigset[T]) incrementSQL(name string) string {
+	if !b.multiplicity {
+		return ""
+	}
+	return fmt.Sprintf("UPDATE \"%v\" SET count = count + 1 WHERE k = ?%v", b.table(name), b.expiry(" AND "))
+}
+
+// Multiplicity returns how many times the element with the same key as
+// `value` has been added to a set, or zero if it is not present.
+// This requires WithMultiplicity.
+func (b *Bigset[T]) Multiplicity(ctx context.Context, name string, value T) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return -1, err
+	}
+	if !b.multiplicity {
+		return -1, errors.New("Multiplicity requires WithMultiplicity.")
+	}
+	exists, err := b.exists(ctx, name)
+	if err != nil {
+		return -1, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	k, _, err := b.mapper(&value)
+	if err != nil {
+		return -1, err
+	}
+	var result int64
+	err = b.db.Reader().QueryRowContext(
+		ctx,
+		fmt.Sprintf("SELECT count FROM \"%v\" WHERE k = ?%v", b.table(name), b.expiry(" AND ")),
+		k,
+	).Scan(&result)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return result, nil
+}
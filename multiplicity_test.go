@@ -0,0 +1,59 @@
+package bigset_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiplicity(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](
+		logger,
+		bigset.WithKeyFunction(func(book *Book) []byte { return []byte(book.Name) }),
+		bigset.WithMultiplicity[Book](),
+		bigset.WithInsertBatchSize[Book](2),
+	)
+	require.Nil(t, err)
+
+	n, err := b.Add(
+		ctx,
+		"foo",
+		Book{Name: "a", Pages: 1},
+		Book{Name: "a", Pages: 2},
+		Book{Name: "b"},
+		Book{Name: "a", Pages: 3},
+	)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+	_, inserted, err := b.GetOrAdd(ctx, "foo", Book{Name: "b"})
+	require.Nil(t, err)
+	require.False(t, inserted)
+	err = b.WithTx(ctx, func(tx *bigset.Tx[Book]) error {
+		_, err := tx.Add(ctx, "foo", Book{Name: "b"})
+		return err
+	})
+	require.Nil(t, err)
+
+	count, err := b.Multiplicity(ctx, "foo", Book{Name: "a"})
+	require.Nil(t, err)
+	require.Equal(t, int64(3), count)
+	count, err = b.Multiplicity(ctx, "foo", Book{Name: "b"})
+	require.Nil(t, err)
+	require.Equal(t, int64(3), count)
+	count, err = b.Multiplicity(ctx, "foo", Book{Name: "c"})
+	require.Nil(t, err)
+	require.Equal(t, int64(0), count)
+
+	// only the first element with each key is stored
+	book, err := b.RetrieveIfExists(ctx, "foo", Book{Name: "a"})
+	require.Nil(t, err)
+	require.Equal(t, 1, book.Pages)
+	n, err = b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	require.Nil(t, b.Close())
+}
@@ -0,0 +1,76 @@
+package bigset
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// metadataTable holds information about the database as a whole.
+const metadataTable = "bigset:metadata"
+
+// WithSchemaVersion records `version` in the database when it is first
+// created, and causes Create to return ErrSchemaMismatch if the database
+// was created with a different version. Changing the version whenever the
+// definition of T changes turns what would otherwise be silently corrupted
+// data into an error when the file is reopened.
+// Files created without a version are given this one when first reopened
+// with it.
+func WithSchemaVersion[T any](version string) option[T] {
+	return func(b *Bigset[T]) error {
+		if version == "" {
+			return errors.New("the schema version must not be empty.")
+		}
+		b.schemaVersion = version
+		return nil
+	}
+}
+
+// checkSchemaVersion records the schema version if none has been recorded,
+// and returns ErrSchemaMismatch if a different one has.
+func (b *Bigset[T]) checkSchemaVersion(ctx context.Context) error {
+	if b.writable() == nil {
+		sql := fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS \"%v\" (key TEXT PRIMARY KEY, value TEXT);",
+			b.table(metadataTable),
+		)
+		if _, err := b.db.Writer().ExecContext(ctx, sql); err != nil {
+			return err
+		}
+		sql = fmt.Sprintf(
+			"INSERT OR IGNORE INTO \"%v\"(key, value) VALUES ('schema version', ?);",
+			b.table(metadataTable),
+		)
+		if _, err := b.db.Writer().ExecContext(ctx, sql, b.schemaVersion); err != nil {
+			return err
+		}
+	}
+	exists, err := tableExists(ctx, b.db.Reader(), b.table(metadataTable))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: no schema version was recorded.", ErrSchemaMismatch)
+	}
+	var stored string
+	err = b.db.Reader().QueryRowContext(
+		ctx,
+		fmt.Sprintf("SELECT value FROM \"%v\" WHERE key = 'schema version'", b.table(metadataTable)),
+	).Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: no schema version was recorded.", ErrSchemaMismatch)
+	}
+	if err != nil {
+		return err
+	}
+	if stored != b.schemaVersion {
+		return fmt.Errorf(
+			"%w: expected %q, but the file has %q.",
+			ErrSchemaMismatch,
+			b.schemaVersion,
+			stored,
+		)
+	}
+	return nil
+}
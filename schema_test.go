@@ -0,0 +1,58 @@
+package bigset_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "schema")
+	b, err := bigset.Create[int](
+		logger,
+		bigset.WithFilename[int](filename),
+		bigset.WithSchemaVersion[int]("1"),
+	)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "foo", 1)
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+
+	// the same version can be reopened
+	b, err = bigset.Create[int](
+		logger,
+		bigset.WithFilename[int](filename),
+		bigset.WithSchemaVersion[int]("1"),
+	)
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+
+	b, err = bigset.Create[int](
+		logger,
+		bigset.WithFilename[int](filename),
+		bigset.WithSchemaVersion[int]("1"),
+		bigset.WithReadOnly[int](),
+	)
+	require.Nil(t, err)
+	require.Nil(t, b.Close())
+
+	// but a different one cannot
+	_, err = bigset.Create[int](
+		logger,
+		bigset.WithFilename[int](filename),
+		bigset.WithSchemaVersion[int]("2"),
+	)
+	require.ErrorIs(t, err, bigset.ErrSchemaMismatch)
+
+	// the check is skipped if no version is given
+	b, err = bigset.Create[int](logger, bigset.WithFilename[int](filename))
+	require.Nil(t, err)
+	n, err := b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+	require.Nil(t, b.Close())
+}
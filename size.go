@@ -0,0 +1,66 @@
+package bigset
+
+import "fmt"
+
+// maxBlobLength is sqlite's default SQLITE_MAX_LENGTH, the largest
+// string or BLOB it will store. Rows are also limited to this size.
+const maxBlobLength = 1000000000
+
+// WithMaxValueSize limits the size, in bytes, of the value stored for
+// each element, as produced by the key function. Adding or replacing an
+// element with a larger value returns ErrValueTooLarge.
+// Regardless of this, elements whose stored key and value together exceed
+// sqlite's limit of 1,000,000,000 bytes are always rejected. Without a key
+// function, only the key is stored, as it is the value.
+func WithMaxValueSize[T any](n int) option[T] {
+	return func(b *Bigset[T]) error {
+		if n < 1 {
+			return fmt.Errorf("the maximum value size must be positive, not %v.", n)
+		}
+		b.maxValueSize = n
+		return nil
+	}
+}
+
+// encode returns the key and value to be stored for an element,
+// checking that they are small enough to be stored.
+func (b *Bigset[T]) encode(value *T) ([]byte, []byte, error) {
+	k, v, err := b.mapper(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if b.maxValueSize > 0 && len(v) > b.maxValueSize {
+		return nil, nil, fmt.Errorf(
+			"%w: the element with key %v is %v bytes, but the limit is %v.",
+			ErrValueTooLarge,
+			describeKey(k),
+			len(v),
+			b.maxValueSize,
+		)
+	}
+	// the value is only stored if it differs from the key, as in row
+	stored := len(k)
+	if b.customKey {
+		stored += len(v)
+	}
+	if stored > maxBlobLength {
+		return nil, nil, fmt.Errorf(
+			"%w: the element with key %v is %v bytes, but sqlite's limit is %v.",
+			ErrValueTooLarge,
+			describeKey(k),
+			stored,
+			maxBlobLength,
+		)
+	}
+	return k, v, nil
+}
+
+// describeKey quotes a key for use in an error message, truncating
+// it if it is long.
+func describeKey(k []byte) string {
+	const limit = 64
+	if len(k) > limit {
+		return fmt.Sprintf("%q...", k[:limit])
+	}
+	return fmt.Sprintf("%q", k)
+}
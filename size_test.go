@@ -0,0 +1,38 @@
+package bigset_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxValueSize(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[string](logger, bigset.WithMaxValueSize[string](100))
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", "small")
+	require.Nil(t, err)
+
+	large := strings.Repeat("x", 200)
+	_, err = b.Add(ctx, "foo", "another", large)
+	require.ErrorIs(t, err, bigset.ErrValueTooLarge)
+	require.Contains(t, err.Error(), "xxx\"...")
+	_, err = b.Supersede(ctx, "foo", large)
+	require.ErrorIs(t, err, bigset.ErrValueTooLarge)
+	_, _, err = b.GetOrAdd(ctx, "foo", large)
+	require.ErrorIs(t, err, bigset.ErrValueTooLarge)
+
+	// nothing from the failed batch was added
+	n, err := b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+
+	_, err = bigset.Create[string](logger, bigset.WithMaxValueSize[string](0))
+	require.Error(t, err)
+
+	require.Nil(t, b.Close())
+}
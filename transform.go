@@ -0,0 +1,426 @@
+package bigset
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Map applies `transform` to each element of `source`, adding the
+// results to `destination` with the same semantics as Add. Elements
+// for which `transform` returns nil are skipped, and any error it
+// returns aborts the operation.
+// Only one element is held in memory at a time, plus the pending inserts.
+// As the inserts are made within a transaction which holds the only write
+// connection, `transform` must not write to this Bigset, or it will
+// deadlock.
+// Returns the number of elements added to `destination`.
+func (b *Bigset[T]) Map(
+	ctx context.Context,
+	source, destination string,
+	transform func(*T) (*T, error),
+) (int64, error) {
+	if err := verifyNames(source, destination); err != nil {
+		return -1, err
+	}
+	if err := b.found(ctx, source); err != nil {
+		return -1, err
+	}
+	if !b.known(destination) {
+		if err := b.initialise(ctx, destination); err != nil {
+			return -1, err
+		}
+	}
+	batch := b.newAddBatch(destination)
+	defer batch.rollback()
+	var buffer T
+	err := b.each(
+		ctx,
+		fmt.Sprintf("SELECT k, COALESCE(v, k) FROM \"%v\"%v", b.table(source), b.expiry(" WHERE ")),
+		&buffer,
+		func(ctx context.Context) error {
+			result, err := transform(&buffer)
+			if err != nil || result == nil {
+				return err
+			}
+			_, err = batch.add(ctx, result)
+			return err
+		},
+	)
+	if err != nil {
+		return -1, err
+	}
+	if err := batch.commit(); err != nil {
+		return -1, err
+	}
+	return batch.affected, nil
+}
+
+// Filter adds each element of `source` for which `keep` returns true
+// to `destination`, with the same semantics as Add.
+// As with Map, `keep` must not write to this Bigset.
+// Returns the number of elements added to `destination`.
+func (b *Bigset[T]) Filter(
+	ctx context.Context,
+	source, destination string,
+	keep func(*T) bool,
+) (int64, error) {
+	return b.Map(ctx, source, destination, func(t *T) (*T, error) {
+		if keep(t) {
+			return t, nil
+		}
+		return nil, nil
+	})
+}
+
+// Reduce folds `f` over every element of a set, one element at a time,
+// starting from `initial`. It is a function rather than a method as
+// methods cannot introduce additional type parameters.
+// The order in which elements are visited is unspecified.
+func Reduce[T any, A any](
+	ctx context.Context,
+	b *Bigset[T],
+	name string,
+	initial A,
+	f func(acc A, item *T) (A, error),
+) (A, error) {
+	result := initial
+	var buffer T
+	err := b.Each(ctx, name, &buffer, func(ctx context.Context) error {
+		var err error
+		result, err = f(result, &buffer)
+		return err
+	})
+	if err != nil {
+		return initial, err
+	}
+	return result, nil
+}
+
+// CountWhere returns the number of elements in a set for which
+// `predicate` returns true.
+func (b *Bigset[T]) CountWhere(
+	ctx context.Context,
+	name string,
+	predicate func(*T) bool,
+) (int64, error) {
+	var result int64
+	var buffer T
+	err := b.Each(ctx, name, &buffer, func(ctx context.Context) error {
+		if predicate(&buffer) {
+			result++
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	return result, nil
+}
+
+// DiscardWhere removes every element of a set for which `predicate`
+// returns true. This is done in two passes: the set is first scanned to
+// find the keys of matching elements, which are then deleted.
+// Both passes happen within a single write transaction, so concurrent
+// writers cannot modify the set in between, but are blocked until the
+// operation is complete.
+// Returns the number of elements removed.
+func (b *Bigset[T]) DiscardWhere(
+	ctx context.Context,
+	name string,
+	predicate func(*T) bool,
+) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if !b.known(name) {
+		if err := b.initialise(ctx, name); err != nil {
+			return -1, err
+		}
+	}
+	var result int64
+	err := b.transact(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(
+			ctx,
+			fmt.Sprintf("SELECT k, COALESCE(v, k) FROM \"%v\"%v", b.table(name), b.expiry(" WHERE ")),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		keys := make([]any, 0)
+		for rows.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var k, v []byte
+			if err := rows.Scan(&k, &v); err != nil {
+				return err
+			}
+			var buffer T
+			if err := b.unmarshal(v, &buffer); err != nil {
+				return err
+			}
+			if predicate(&buffer) {
+				keys = append(keys, k)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		result, err = discardKeys(ctx, tx, b.table(name), keys)
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+	return result, nil
+}
+
+// Dedup rewrites a set so that each element is keyed by `newKey` rather
+// than the key it was added with, as if it had been added afresh using
+// WithKeyFunction(newKey). Where several elements now share a key, the
+// first to have been added is kept; if WithWithoutRowid was used, the
+// order in which elements were added is not known, so the one with the
+// lowest original key is kept instead.
+// The set is rewritten within a single write transaction, so concurrent
+// writers are blocked until it is complete.
+// Once a set has been rewritten, it should only be written to by a
+// Bigset using the same key function.
+// Expired elements are purged rather than rewritten, and are not counted.
+// A set which does not exist is treated as empty.
+// Returns the number of elements removed.
+func (b *Bigset[T]) Dedup(ctx context.Context, name string, newKey func(*T) []byte) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return -1, err
+	}
+	exists, err := b.exists(ctx, name)
+	if err != nil {
+		return -1, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	// the other columns are copied unchanged
+	columns := []string{"v"}
+	values := []string{"COALESCE(v, k)"}
+	for _, c := range b.extraColumns {
+		columns = append(columns, fmt.Sprintf("\"%v\"", c.Name))
+		values = append(values, fmt.Sprintf("\"%v\"", c.Name))
+	}
+	if b.ttl > 0 {
+		columns = append(columns, "inserted_at")
+		values = append(values, "inserted_at")
+	}
+	if b.multiplicity {
+		columns = append(columns, "count")
+		values = append(values, "count")
+	}
+	order := "rowid"
+	if b.withoutRowid {
+		order = "k"
+	}
+	temporary := temporaryName()
+	var removed int64
+	err = b.transact(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, b.createSQL(temporary)); err != nil {
+			return err
+		}
+		insert, err := tx.PrepareContext(ctx, fmt.Sprintf(
+			"INSERT OR IGNORE INTO \"%v\"(k, %v) SELECT ?, %v FROM \"%v\" WHERE k = ?",
+			b.table(temporary),
+			strings.Join(columns, ", "),
+			strings.Join(values, ", "),
+			b.table(name),
+		))
+		if err != nil {
+			return err
+		}
+		defer insert.Close()
+		rows, err := tx.QueryContext(
+			ctx,
+			fmt.Sprintf(
+				"SELECT k, COALESCE(v, k) FROM \"%v\"%v ORDER BY %v",
+				b.table(name),
+				b.expiry(" WHERE "),
+				order,
+			),
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var k, v []byte
+			if err := rows.Scan(&k, &v); err != nil {
+				return err
+			}
+			var buffer T
+			if err := b.unmarshal(v, &buffer); err != nil {
+				return err
+			}
+			key := newKey(&buffer)
+			if key == nil {
+				return fmt.Errorf("the new key of the element with key %v is nil.", describeKey(k))
+			}
+			result, err := insert.ExecContext(ctx, key, k)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			removed += 1 - n
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		// the original table cannot be dropped while it is being read
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		if err := insert.Close(); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DROP TABLE \"%v\"", b.table(name))); err != nil {
+			return err
+		}
+		sql := fmt.Sprintf("ALTER TABLE \"%v\" RENAME TO \"%v\"", b.table(temporary), b.table(name))
+		if _, err := tx.ExecContext(ctx, sql); err != nil {
+			return err
+		}
+		return b.moveIndexes(ctx, tx, temporary, name)
+	})
+	b.forgetFilter(name)
+	b.forgetStatements(name)
+	if err != nil {
+		return -1, err
+	}
+	return removed, nil
+}
+
+// Partition splits `src` into `n` sets, named `src` followed by "_shard_"
+// and the shard number, adding each element to shard `shard(element) % n`
+// with the same semantics as Add. Shards are only created if an element
+// is routed to them.
+// Returns the number of elements added to each shard.
+func (b *Bigset[T]) Partition(
+	ctx context.Context,
+	src string,
+	n int,
+	shard func(*T) int,
+) (map[int]int64, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("%v is not a valid number of shards.", n)
+	}
+	shards := make(map[string]int)
+	counts, err := b.route(ctx, src, func(t *T) (string, error) {
+		// a negative result from shard still selects a valid shard
+		i := (shard(t)%n + n) % n
+		name := fmt.Sprintf("%v_shard_%v", src, i)
+		shards[name] = i
+		return name, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int]int64, len(counts))
+	for name, count := range counts {
+		result[shards[name]] = count
+	}
+	return result, nil
+}
+
+// GroupBy adds each element of `src` to the set named by `label(element)`,
+// with the same semantics as Add. Sets are only created if an element is
+// routed to them. If `label` returns an invalid set name, the operation
+// is aborted with an error wrapping ErrInvalidName, although elements
+// already routed to other sets may have been added.
+// Returns the number of elements added to each set.
+func (b *Bigset[T]) GroupBy(
+	ctx context.Context,
+	src string,
+	label func(*T) string,
+) (map[string]int64, error) {
+	return b.route(ctx, src, func(t *T) (string, error) {
+		return label(t), nil
+	})
+}
+
+// route adds each element of `src` to the set named by `destination`,
+// with the same semantics as Add.
+// Elements are buffered in memory until there are enough to fill a batch,
+// at which point each destination is written to in turn, as only one
+// batch can be in progress at a time.
+// Returns the number of elements added to each destination.
+func (b *Bigset[T]) route(
+	ctx context.Context,
+	src string,
+	destination func(*T) (string, error),
+) (map[string]int64, error) {
+	if err := verifyNames(src); err != nil {
+		return nil, err
+	}
+	if err := b.found(ctx, src); err != nil {
+		return nil, err
+	}
+	result := make(map[string]int64)
+	pending := make(map[string][]T)
+	var size int
+	flush := func() error {
+		for name, values := range pending {
+			n, err := b.add(ctx, b.newAddBatch(name), values...)
+			if err != nil {
+				return err
+			}
+			result[name] += n
+			delete(pending, name)
+		}
+		size = 0
+		return nil
+	}
+	var buffer T
+	err := b.each(
+		ctx,
+		fmt.Sprintf("SELECT k, COALESCE(v, k) FROM \"%v\"%v", b.table(src), b.expiry(" WHERE ")),
+		&buffer,
+		func(ctx context.Context) error {
+			name, err := destination(&buffer)
+			if err != nil {
+				return err
+			}
+			if err := verifyNames(name); err != nil {
+				return err
+			}
+			if _, ok := result[name]; !ok {
+				result[name] = 0
+			}
+			// each resets the buffer before decoding the next element,
+			// so this copy does not share its slices and maps
+			pending[name] = append(pending[name], buffer)
+			size++
+			if size >= b.batchSize {
+				return flush()
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
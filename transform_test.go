@@ -0,0 +1,323 @@
+package bigset_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMap(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3, 4)
+	require.Nil(t, err)
+
+	// square the odd numbers, dropping the even ones
+	n, err := b.Map(ctx, "foo", "bar", func(i *int) (*int, error) {
+		if *i%2 == 0 {
+			return nil, nil
+		}
+		result := *i * *i
+		return &result, nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	nums, err := b.Get(ctx, "bar")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 9}, *nums)
+
+	// errors abort the operation
+	failure := errors.New("failure")
+	_, err = b.Map(ctx, "foo", "baz", func(i *int) (*int, error) {
+		return nil, failure
+	})
+	require.ErrorIs(t, err, failure)
+
+	require.Nil(t, b.Close())
+}
+
+// Item omits its empty fields when stored, so decoding one must not leave
+// behind the fields of the element decoded before it.
+type Item struct {
+	ID   string
+	N    int      `json:",omitempty"`
+	Tags []string `json:",omitempty"`
+}
+
+// items returns a Bigset holding a full Item and an empty one in "src",
+// in that order.
+func items(t *testing.T) *bigset.Bigset[Item] {
+	b, err := bigset.Create[Item](
+		logger,
+		bigset.WithKeyFunction(func(i *Item) []byte { return []byte(i.ID) }),
+		bigset.WithInsertionOrder[Item](),
+	)
+	require.Nil(t, err)
+	_, err = b.Add(context.Background(), "src", Item{ID: "a", N: 5, Tags: []string{"x"}}, Item{ID: "b"})
+	require.Nil(t, err)
+	return b
+}
+
+func TestMapEmptyFields(t *testing.T) {
+	ctx := context.Background()
+	b := items(t)
+
+	_, err := b.Map(ctx, "src", "dst", func(i *Item) (*Item, error) { return i, nil })
+	require.Nil(t, err)
+	values, err := b.Slice(ctx, "dst")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []Item{{ID: "a", N: 5, Tags: []string{"x"}}, {ID: "b"}}, values)
+
+	require.Nil(t, b.Close())
+}
+
+func TestFilter(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](logger)
+	require.Nil(t, err)
+
+	martin := Book{Name: "Martin the Warrior", Pages: 375, Favourite: true}
+	mossflower := Book{Name: "Mossflower", Pages: 420}
+	salamandastron := Book{Name: "Salamandastron", Pages: 336, Favourite: true}
+	_, err = b.Add(ctx, "books", martin, mossflower, salamandastron)
+	require.Nil(t, err)
+
+	n, err := b.Filter(ctx, "books", "favourites", func(book *Book) bool {
+		return book.Favourite
+	})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	books, err := b.Get(ctx, "favourites")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []Book{martin, salamandastron}, *books)
+
+	require.Nil(t, b.Close())
+}
+
+func TestFilterEmptyFields(t *testing.T) {
+	ctx := context.Background()
+	b := items(t)
+
+	n, err := b.Filter(ctx, "src", "dst", func(i *Item) bool { return i.Tags == nil })
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+	values, err := b.Slice(ctx, "dst")
+	require.Nil(t, err)
+	require.Equal(t, []Item{{ID: "b"}}, values)
+
+	require.Nil(t, b.Close())
+}
+
+func TestReduce(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[Book](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(
+		ctx,
+		"books",
+		Book{Name: "Martin the Warrior", Pages: 375},
+		Book{Name: "Mossflower", Pages: 420},
+	)
+	require.Nil(t, err)
+
+	pages, err := bigset.Reduce(ctx, b, "books", 0, func(total int, book *Book) (int, error) {
+		return total + book.Pages, nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 795, pages)
+
+	require.Nil(t, b.Close())
+}
+
+func TestReduceEmptyFields(t *testing.T) {
+	ctx := context.Background()
+	b := items(t)
+
+	tags, err := bigset.Reduce(ctx, b, "src", 0, func(total int, i *Item) (int, error) {
+		return total + len(i.Tags), nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, tags)
+
+	require.Nil(t, b.Close())
+}
+
+func TestCountWhere(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3, 4, 5)
+	require.Nil(t, err)
+
+	n, err := b.CountWhere(ctx, "foo", func(i *int) bool {
+		return *i > 2
+	})
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestCountWhereEmptyFields(t *testing.T) {
+	ctx := context.Background()
+	b := items(t)
+
+	n, err := b.CountWhere(ctx, "src", func(i *Item) bool { return i.N == 5 })
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+
+	require.Nil(t, b.Close())
+}
+
+func TestDiscardWhere(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2, 3, 4, 5, 6)
+	require.Nil(t, err)
+
+	n, err := b.DiscardWhere(ctx, "foo", func(i *int) bool {
+		return *i%3 == 0
+	})
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	nums, err := b.Get(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 2, 4, 5}, *nums)
+
+	require.Nil(t, b.Close())
+}
+
+func TestDedup(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "db")
+	b, err := bigset.Create[int](logger, bigset.WithFilename[int](filename))
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 5, 9, 1, 2, 4, 3)
+	require.Nil(t, err)
+
+	// the first element added with each remainder is kept
+	remainder := func(i *int) []byte { return []byte{byte(*i % 3)} }
+	n, err := b.Dedup(ctx, "foo", remainder)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+	nums, err := b.Slice(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{5, 9, 1}, nums)
+	require.Nil(t, b.Close())
+
+	// the set is now keyed by the new key function
+	b, err = bigset.Create[int](logger, bigset.WithFilename[int](filename), bigset.WithKeyFunction(remainder))
+	require.Nil(t, err)
+	found, err := b.RetrieveIfExists(ctx, "foo", 7)
+	require.Nil(t, err)
+	require.Equal(t, 1, *found)
+	n, err = b.Add(ctx, "foo", 6)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+
+	n, err = b.Dedup(ctx, "missing", remainder)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+	_, err = b.Dedup(ctx, "foo", func(i *int) []byte { return nil })
+	require.Error(t, err)
+	nums, err = b.Slice(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{5, 9, 1}, nums)
+
+	require.Nil(t, b.Close())
+}
+
+func TestPartition(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger, bigset.WithInsertBatchSize[int](7))
+	require.Nil(t, err)
+	nums := make([]int, 100)
+	for i := range nums {
+		nums[i] = i - 50
+	}
+	_, err = b.AddSlice(ctx, "nums", nums)
+	require.Nil(t, err)
+
+	counts, err := b.Partition(ctx, "nums", 3, func(i *int) int { return *i })
+	require.Nil(t, err)
+	require.Equal(t, map[int]int64{0: 33, 1: 34, 2: 33}, counts)
+
+	var total int64
+	for i := range 3 {
+		n, err := b.Cardinality(ctx, fmt.Sprintf("nums_shard_%v", i))
+		require.Nil(t, err)
+		require.Equal(t, counts[i], n)
+		total += n
+	}
+	require.Equal(t, int64(100), total)
+
+	_, err = b.Partition(ctx, "nums", 0, func(i *int) int { return *i })
+	require.Error(t, err)
+
+	require.Nil(t, b.Close())
+}
+
+func TestGroupBy(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "nums", 1, 2, 3, 4, 5)
+	require.Nil(t, err)
+
+	counts, err := b.GroupBy(ctx, "nums", func(i *int) string {
+		if *i%2 == 0 {
+			return "even"
+		}
+		return "odd"
+	})
+	require.Nil(t, err)
+	require.Equal(t, map[string]int64{"even": 2, "odd": 3}, counts)
+	evens, err := b.Get(ctx, "even")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{2, 4}, *evens)
+
+	_, err = b.GroupBy(ctx, "nums", func(i *int) string { return "bad\"label" })
+	require.ErrorIs(t, err, bigset.ErrInvalidName)
+	require.ErrorContains(t, err, "bad\\\"label")
+
+	require.Nil(t, b.Close())
+}
+
+func TestGroupByReferenceTypes(t *testing.T) {
+	ctx := context.Background()
+	type Tagged struct {
+		Tags map[string]int
+		L    []int
+	}
+	b, err := bigset.Create[Tagged](logger)
+	require.Nil(t, err)
+	first := Tagged{Tags: map[string]int{"a": 1}, L: []int{1}}
+	second := Tagged{Tags: map[string]int{"b": 2}, L: []int{2}}
+	_, err = b.Add(ctx, "src", first, second)
+	require.Nil(t, err)
+
+	// elements buffered together must not share their maps or slices
+	counts, err := b.GroupBy(ctx, "src", func(*Tagged) string { return "all" })
+	require.Nil(t, err)
+	require.Equal(t, map[string]int64{"all": 2}, counts)
+	values, err := b.Slice(ctx, "all")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []Tagged{first, second}, values)
+
+	require.Nil(t, b.Close())
+}
@@ -0,0 +1,75 @@
+package bigset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// nowMillis is an SQL expression giving the current time,
+// in milliseconds since the Unix epoch.
+const nowMillis = "CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER)"
+
+// WithTTL causes elements to expire once `d` has passed since they were
+// added. Expiry is lazy: expired elements are hidden from Cardinality,
+// IsEmpty, Each, EachOrdered, All, Stream, Get, RetrieveIfExists, Sample,
+// GetPage and the key iterators, and are replaced if added again, but
+// remain on disk until PurgeExpired is called.
+// Other operations, notably set operations such as Union, Intersection
+// and Subtract, do not check for expiry, so PurgeExpired should be called
+// first if expired elements must not be included. Elements added to a set
+// by a set operation expire `d` after the operation.
+// Supersede resets an element's expiry, as if it were newly added,
+// while Refresh does not.
+// This only applies to sets created while this option is in use.
+func WithTTL[T any](d time.Duration) option[T] {
+	return func(b *Bigset[T]) error {
+		if d < time.Millisecond {
+			return errors.New("the TTL must be at least one millisecond.")
+		}
+		b.ttl = d
+		return nil
+	}
+}
+
+// unexpired returns an SQL condition which is true if `column`, giving
+// the time an element was inserted, has not yet expired.
+func (b *Bigset[T]) unexpired(column string) string {
+	return fmt.Sprintf("%v > %v - %v", column, nowMillis, b.ttl.Milliseconds())
+}
+
+// expiry returns `prefix` followed by a condition excluding expired
+// elements, or nothing if elements do not expire.
+func (b *Bigset[T]) expiry(prefix string) string {
+	if b.ttl <= 0 {
+		return ""
+	}
+	return prefix + b.unexpired("inserted_at")
+}
+
+// PurgeExpired removes the expired elements from a set.
+// Returns the number of elements removed, which is always zero
+// if WithTTL is not in use.
+func (b *Bigset[T]) PurgeExpired(ctx context.Context, name string) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if err := b.found(ctx, name); err != nil {
+		return -1, err
+	}
+	if b.ttl <= 0 {
+		return 0, nil
+	}
+	exists, err := b.exists(ctx, name)
+	if err != nil {
+		return -1, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	return b.apply(
+		ctx,
+		fmt.Sprintf("DELETE FROM \"%v\" WHERE NOT (%v)", b.table(name), b.unexpired("inserted_at")),
+	)
+}
@@ -0,0 +1,142 @@
+package bigset_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger, bigset.WithTTL[int](200*time.Millisecond))
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1, 2)
+	require.Nil(t, err)
+	time.Sleep(300 * time.Millisecond)
+	_, err = b.Add(ctx, "foo", 3)
+	require.Nil(t, err)
+	_, err = b.Supersede(ctx, "foo", 2)
+	require.Nil(t, err)
+
+	// 1 has expired, but is still on disk
+	n, err := b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+	nums, err := b.Get(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{2, 3}, *nums)
+	missing, err := b.RetrieveIfExists(ctx, "foo", 1)
+	require.Nil(t, err)
+	require.Nil(t, missing)
+
+	// until it is purged
+	n, err = b.PurgeExpired(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+
+	// adding an expired element makes it live again
+	time.Sleep(300 * time.Millisecond)
+	empty, err := b.IsEmpty(ctx, "foo")
+	require.Nil(t, err)
+	require.True(t, empty)
+	n, err = b.Add(ctx, "foo", 3)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+	n, err = b.Cardinality(ctx, "foo")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+
+	// set operations include expired elements which have not been purged
+	_, err = b.Union(ctx, "bar", "foo")
+	require.Nil(t, err)
+	n, err = b.Cardinality(ctx, "bar")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), n)
+
+	require.Nil(t, b.Close())
+
+	_, err = bigset.Create[int](logger, bigset.WithTTL[int](0))
+	require.Error(t, err)
+}
+
+func TestTTLExcludesExpired(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger, bigset.WithTTL[int](200*time.Millisecond))
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "foo", 1)
+	require.Nil(t, err)
+	time.Sleep(300 * time.Millisecond)
+
+	// expired elements are not popped, counted within a transaction,
+	// or exported
+	popped, err := b.Pop(ctx, "foo")
+	require.Nil(t, err)
+	require.Nil(t, popped)
+	err = b.WithTx(ctx, func(tx *bigset.Tx[int]) error {
+		n, err := tx.Cardinality(ctx, "foo")
+		require.Equal(t, int64(0), n)
+		return err
+	})
+	require.Nil(t, err)
+	var out strings.Builder
+	n, err := b.Export(ctx, "foo", &out)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+	require.Empty(t, out.String())
+
+	require.Nil(t, b.Close())
+}
+
+func TestTTLComparisons(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger, bigset.WithTTL[int](200*time.Millisecond))
+	require.Nil(t, err)
+
+	_, err = b.Add(ctx, "a", 1)
+	require.Nil(t, err)
+	time.Sleep(300 * time.Millisecond)
+	_, err = b.Add(ctx, "a", 2)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "b", 2)
+	require.Nil(t, err)
+
+	// comparisons ignore expired elements, on either side
+	equal, err := b.Equals(ctx, "a", "b")
+	require.Nil(t, err)
+	require.True(t, equal)
+	subset, err := b.IsSubset(ctx, "a", "b")
+	require.Nil(t, err)
+	require.True(t, subset)
+	n, err := b.DifferenceCardinality(ctx, "a", "b")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+	_, err = b.Add(ctx, "c", 1)
+	require.Nil(t, err)
+	disjoint, err := b.IsDisjoint(ctx, "a", "c")
+	require.Nil(t, err)
+	require.True(t, disjoint)
+
+	// as do rewrites
+	n, err = b.DiscardWhere(ctx, "a", func(*int) bool { return true })
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+	_, err = b.Add(ctx, "d", 1)
+	require.Nil(t, err)
+	time.Sleep(300 * time.Millisecond)
+	_, err = b.Add(ctx, "d", 2)
+	require.Nil(t, err)
+	n, err = b.Dedup(ctx, "d", func(*int) []byte { return []byte{0} })
+	require.Nil(t, err)
+	require.Equal(t, int64(0), n)
+	nums, err := b.Slice(ctx, "d")
+	require.Nil(t, err)
+	require.Equal(t, []int{2}, nums)
+
+	require.Nil(t, b.Close())
+}
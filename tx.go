@@ -0,0 +1,273 @@
+package bigset
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+)
+
+// Tx performs operations on a Bigset within a single transaction,
+// so that they either all succeed or all fail. It is only valid
+// within the function passed to WithTx.
+type Tx[T any] struct {
+	b  *Bigset[T]
+	tx *sql.Tx
+	// sets created within this transaction, which are only
+	// remembered once it has been committed
+	created []string
+}
+
+// WithTx runs `fn` within a single write transaction, committing it if
+// `fn` returns nil and rolling it back otherwise.
+// Other writers are blocked until `fn` returns. As the transaction holds
+// the only write connection, `fn` must not modify the Bigset other than
+// through the Tx, or it will block forever.
+func (b *Bigset[T]) WithTx(ctx context.Context, fn func(tx *Tx[T]) error) error {
+	t := &Tx[T]{b: b}
+	err := b.transact(ctx, func(tx *sql.Tx) error {
+		t.tx = tx
+		return fn(t)
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range t.created {
+		b.remember(name)
+	}
+	return nil
+}
+
+// Savepoint marks the current state of the transaction, so that later
+// operations can be undone without abandoning the whole transaction.
+// Exactly one of the returned functions should be called: `release` keeps
+// the changes made since the savepoint, while `rollback` discards them.
+// Savepoints can be nested, as long as inner ones are released or rolled
+// back before outer ones. Releasing a savepoint does not commit anything;
+// that only happens when the transaction itself is committed.
+func (t *Tx[T]) Savepoint(
+	ctx context.Context,
+	name string,
+) (release func() error, rollback func() error, err error) {
+	if err := verifyNames(name); err != nil {
+		return nil, nil, err
+	}
+	if _, err := t.tx.ExecContext(ctx, fmt.Sprintf("SAVEPOINT \"%v\"", name)); err != nil {
+		return nil, nil, err
+	}
+	created := len(t.created)
+	release = func() error {
+		_, err := t.tx.ExecContext(ctx, fmt.Sprintf("RELEASE \"%v\"", name))
+		return err
+	}
+	rollback = func() error {
+		// ROLLBACK TO leaves the savepoint in place, so it must
+		// also be released
+		if _, err := t.tx.ExecContext(ctx, fmt.Sprintf("ROLLBACK TO \"%v\"", name)); err != nil {
+			return err
+		}
+		t.created = t.created[:created]
+		return release()
+	}
+	return release, rollback, nil
+}
+
+// initialise creates the named set within the transaction, if required.
+func (t *Tx[T]) initialise(ctx context.Context, name string) error {
+	if t.b.known(name) || slices.Contains(t.created, name) {
+		return nil
+	}
+	if t.b.strictSets {
+		return t.found(ctx, name)
+	}
+	if _, err := t.tx.ExecContext(ctx, t.b.createSQL(name)); err != nil {
+		return err
+	}
+	t.created = append(t.created, name)
+	return nil
+}
+
+// found is like Bigset.found, but also sees sets created within
+// the transaction.
+func (t *Tx[T]) found(ctx context.Context, names ...string) error {
+	if !t.b.strictSets {
+		return nil
+	}
+	for _, name := range names {
+		if t.b.known(name) || slices.Contains(t.created, name) {
+			continue
+		}
+		exists, err := tableExists(ctx, t.tx, t.b.table(name))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: %v.", ErrSetNotFound, name)
+		}
+	}
+	return nil
+}
+
+// apply executes a statement, returning the number of affected rows.
+func (t *Tx[T]) apply(ctx context.Context, sql string) (int64, error) {
+	result, err := t.tx.ExecContext(ctx, sql)
+	if err != nil {
+		return -1, err
+	}
+	return result.RowsAffected()
+}
+
+// add executes `sql` with the key and value of each element. If `increment`
+// is true, the multiplicity of each element which is already present is
+// incremented, as Add does.
+// As `sql` already contains the name, callers must verify it first.
+func (t *Tx[T]) add(ctx context.Context, name string, sql string, increment bool, values []T) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if err := t.initialise(ctx, name); err != nil {
+		return -1, err
+	}
+	stmt, err := t.tx.PrepareContext(ctx, sql)
+	if err != nil {
+		return -1, err
+	}
+	defer stmt.Close()
+	var incrementSQL string
+	if increment {
+		incrementSQL = t.b.incrementSQL(name)
+	}
+	var result int64
+	for i := range values {
+		k, args, err := t.b.row(&values[i])
+		if err != nil {
+			return -1, err
+		}
+		execResult, err := stmt.ExecContext(ctx, args...)
+		if err != nil {
+			return -1, err
+		}
+		ra, err := execResult.RowsAffected()
+		if err != nil {
+			return -1, err
+		}
+		t.b.filterAdd(name, k)
+		if ra == 0 && incrementSQL != "" {
+			if _, err := t.tx.ExecContext(ctx, incrementSQL, k); err != nil {
+				return -1, err
+			}
+		}
+		result += ra
+	}
+	return result, nil
+}
+
+// Add is like Bigset.Add, within the transaction.
+func (t *Tx[T]) Add(ctx context.Context, name string, values ...T) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	return t.add(ctx, name, t.b.addSQL(name), true, values)
+}
+
+// Supersede is like Bigset.Supersede, within the transaction.
+func (t *Tx[T]) Supersede(ctx context.Context, name string, values ...T) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	return t.add(ctx, name, t.b.supersedeSQL(name), false, values)
+}
+
+// Discard is like Bigset.Discard, within the transaction.
+func (t *Tx[T]) Discard(ctx context.Context, name string, values ...T) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if err := t.initialise(ctx, name); err != nil {
+		return -1, err
+	}
+	keys := make([]any, 0, len(values))
+	for i := range values {
+		k, _, err := t.b.mapper(&values[i])
+		if err != nil {
+			return -1, err
+		}
+		keys = append(keys, k)
+	}
+	return discardKeys(ctx, t.tx, t.b.table(name), keys)
+}
+
+// Union is like Bigset.Union, within the transaction.
+func (t *Tx[T]) Union(ctx context.Context, target string, source ...string) (int64, error) {
+	if err := verifyNames(target, source...); err != nil {
+		return -1, err
+	}
+	if err := t.initialise(ctx, target); err != nil {
+		return -1, err
+	}
+	if err := t.found(ctx, source...); err != nil {
+		return -1, err
+	}
+	if len(source) < 1 {
+		return 0, nil
+	}
+	defer t.b.forgetFilter(target)
+	return t.apply(ctx, t.b.unionSQL(target, source))
+}
+
+// Intersection is like Bigset.Intersection, within the transaction.
+func (t *Tx[T]) Intersection(ctx context.Context, target string, source ...string) (int64, error) {
+	if err := verifyNames(target, source...); err != nil {
+		return -1, err
+	}
+	if err := t.initialise(ctx, target); err != nil {
+		return -1, err
+	}
+	if err := t.found(ctx, source...); err != nil {
+		return -1, err
+	}
+	if len(source) < 1 {
+		return 0, nil
+	}
+	defer t.b.forgetFilter(target)
+	return t.apply(ctx, t.b.intersectionSQL(target, source[0], source))
+}
+
+// Subtract is like Bigset.Subtract, within the transaction.
+func (t *Tx[T]) Subtract(ctx context.Context, target string, source ...string) (int64, error) {
+	if err := verifyNames(target, source...); err != nil {
+		return -1, err
+	}
+	if err := t.initialise(ctx, target); err != nil {
+		return -1, err
+	}
+	if err := t.found(ctx, source...); err != nil {
+		return -1, err
+	}
+	var result int64
+	for _, sTable := range source {
+		n, err := t.apply(ctx, t.b.subtractSQL(target, sTable))
+		if err != nil {
+			return -1, err
+		}
+		result += n
+	}
+	return result, nil
+}
+
+// Cardinality is like Bigset.Cardinality, within the transaction,
+// so includes any changes already made by it.
+func (t *Tx[T]) Cardinality(ctx context.Context, name string) (int64, error) {
+	if err := verifyNames(name); err != nil {
+		return -1, err
+	}
+	if err := t.found(ctx, name); err != nil {
+		return -1, err
+	}
+	var result int64
+	sql := fmt.Sprintf("SELECT COUNT(*) FROM \"%v\"%v", t.b.table(name), t.b.expiry(" WHERE "))
+	if err := t.tx.QueryRowContext(ctx, sql).Scan(&result); err != nil {
+		return -1, err
+	}
+	return result, nil
+}
@@ -0,0 +1,107 @@
+package bigset_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nicois/bigset"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTx(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+	_, err = b.Add(ctx, "b", 1, 2, 3)
+	require.Nil(t, err)
+
+	err = b.WithTx(ctx, func(tx *bigset.Tx[int]) error {
+		n, err := tx.Add(ctx, "a", 1, 4)
+		require.Nil(t, err)
+		require.Equal(t, int64(2), n)
+		n, err = tx.Subtract(ctx, "b", "a")
+		require.Nil(t, err)
+		require.Equal(t, int64(1), n)
+		n, err = tx.Union(ctx, "c", "a", "b")
+		require.Nil(t, err)
+		require.Equal(t, int64(4), n)
+		n, err = tx.Cardinality(ctx, "c")
+		require.Nil(t, err)
+		require.Equal(t, int64(4), n)
+		return nil
+	})
+	require.Nil(t, err)
+	c, err := b.Get(ctx, "c")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 2, 3, 4}, *c)
+
+	// nothing is kept if the function fails
+	failure := errors.New("failure")
+	err = b.WithTx(ctx, func(tx *bigset.Tx[int]) error {
+		_, err := tx.Discard(ctx, "c", 1, 2)
+		require.Nil(t, err)
+		_, err = tx.Add(ctx, "d", 1)
+		require.Nil(t, err)
+		n, err := tx.Intersection(ctx, "e", "c", "d")
+		require.Nil(t, err)
+		require.Equal(t, int64(0), n)
+		return failure
+	})
+	require.ErrorIs(t, err, failure)
+	n, err := b.Cardinality(ctx, "c")
+	require.Nil(t, err)
+	require.Equal(t, int64(4), n)
+	empty, err := b.IsEmpty(ctx, "d")
+	require.Nil(t, err)
+	require.True(t, empty)
+	names, err := b.ListSets(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, names)
+
+	require.Nil(t, b.Close())
+}
+
+func TestSavepoint(t *testing.T) {
+	ctx := context.Background()
+	b, err := bigset.Create[int](logger)
+	require.Nil(t, err)
+
+	err = b.WithTx(ctx, func(tx *bigset.Tx[int]) error {
+		_, err := tx.Add(ctx, "foo", 1)
+		require.Nil(t, err)
+
+		release, _, err := tx.Savepoint(ctx, "outer")
+		require.Nil(t, err)
+		_, err = tx.Add(ctx, "foo", 2)
+		require.Nil(t, err)
+
+		// an inner savepoint can be rolled back on its own
+		_, rollback, err := tx.Savepoint(ctx, "inner")
+		require.Nil(t, err)
+		_, err = tx.Add(ctx, "foo", 3)
+		require.Nil(t, err)
+		_, err = tx.Add(ctx, "bar", 3)
+		require.Nil(t, err)
+		require.Nil(t, rollback())
+
+		require.Nil(t, release())
+		n, err := tx.Cardinality(ctx, "foo")
+		require.Nil(t, err)
+		require.Equal(t, int64(2), n)
+		return nil
+	})
+	require.Nil(t, err)
+
+	nums, err := b.Get(ctx, "foo")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []int{1, 2}, *nums)
+	// the set created within the rolled back savepoint does not exist
+	names, err := b.ListSets(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []string{"foo"}, names)
+	_, err = b.Add(ctx, "bar", 1)
+	require.Nil(t, err)
+
+	require.Nil(t, b.Close())
+}